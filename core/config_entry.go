@@ -0,0 +1,51 @@
+package api
+
+const (
+	ConfigEntryServiceDefaults   = "service-defaults"
+	ConfigEntryServiceIntentions = "service-intentions"
+
+	IntentionActionAllow = "allow"
+	IntentionActionDeny  = "deny"
+)
+
+// ServiceDefaults is a service-defaults config entry. Config entries are
+// missing from the vendored consulapi, so they are sent through the raw API.
+type ServiceDefaults struct {
+	Kind                  string
+	Name                  string
+	Protocol              string            `json:",omitempty"`
+	MaxInboundConnections int               `json:",omitempty"`
+	Meta                  map[string]string `json:",omitempty"`
+}
+
+// ServiceIntentions is the service-intentions config entry of a destination
+// service.
+type ServiceIntentions struct {
+	Kind    string
+	Name    string
+	Sources []SourceIntention
+	Meta    map[string]string `json:",omitempty"`
+}
+
+type SourceIntention struct {
+	Name        string
+	Action      string
+	Description string `json:",omitempty"`
+}
+
+// ListConfigEntries decodes the config entries of a kind into entries, a
+// pointer to a slice.
+func (cb *ConsulBackend) ListConfigEntries(kind string, entries interface{}) error {
+	_, err := cb.client.Raw().Query("/v1/config/"+kind, entries, nil)
+	return err
+}
+
+// SetConfigEntry creates or replaces a config entry.
+func (cb *ConsulBackend) SetConfigEntry(entry interface{}) error {
+	_, err := cb.client.Raw().Write("/v1/config", entry, nil, nil)
+	return err
+}
+
+func (cb *ConsulBackend) DeleteConfigEntry(kind, name string) error {
+	return cb.rawDelete("/v1/config/" + kind + "/" + name)
+}
@@ -1,19 +1,71 @@
 package api
 
 import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
 	"github.com/golang/glog"
 	consulapi "github.com/hashicorp/consul/api"
 )
 
 type ConsulBackend struct {
 	client *consulapi.Client
+	config *consulapi.Config
+
+	// Agents the requests are sent to, nil for a backend bound to one agent
+	agents *agentPool
+
+	// Session the services KV are bound to, see UseSession
+	session *kvSession
+
+	// Set to 1 once Consul answered that it doesn't support transactions,
+	// read and written with sync/atomic as the plugins apply KV concurrently
+	txnUnsupported int32
+
+	// Backends of the Consul Enterprise scopes, see Scoped
+	scopes     map[Scope]*ConsulBackend
+	scopesLock sync.Mutex
+
+	// Name of the target when the backend is one of several, see
+	// ContinueOnError
+	target string
+
+	// Last error of the backend and its scopes, see LastError
+	lastError *backendError
+}
+
+type backendError struct {
+	msg string
+	at  time.Time
+	sync.Mutex
 }
 
 func NewConsulClient(consulAPI string) *ConsulBackend {
-	cb := new(ConsulBackend)
+	return NewConsulTargetClient(consulAPI, "", "")
+}
+
+// NewConsulTargetClient returns a backend with its own token and
+// datacenter, the agent ones being used when they are empty. consulAPI is a
+// list of agents, the backend failing over to the next one when its agent
+// doesn't answer.
+func NewConsulTargetClient(consulAPI, token, datacenter string) *ConsulBackend {
+	cb := &ConsulBackend{scopes: make(map[Scope]*ConsulBackend), session: &kvSession{}, lastError: &backendError{}}
 
 	config := consulapi.DefaultConfig()
-	config.Address = consulAPI
+	config.Token = token
+	config.Datacenter = datacenter
+	cb.config = config
+
+	base := config.HttpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	cb.agents = newAgentPool(splitAgents(consulAPI), config.Scheme, base)
+	config.Address = cb.agents.Current()
+	config.HttpClient = &http.Client{Transport: &failoverTransport{pool: cb.agents}, Timeout: config.HttpClient.Timeout}
+	go cb.agents.check()
 
 	if consulClient, err := consulapi.NewClient(config); err == nil {
 		cb.client = consulClient
@@ -28,15 +80,59 @@ func (cb *ConsulBackend) Client() *consulapi.Client {
 	return cb.client
 }
 
+// ContinueOnError makes the errors of a backend non fatal, so that the
+// outage of one target doesn't stop the others.
+func (cb *ConsulBackend) ContinueOnError(target string) {
+	cb.target = target
+}
+
+func (cb *ConsulBackend) fail(msg string, err error) {
+	cb.setLastError(msg, err)
+
+	if cb.target == "" {
+		glog.Fatalln(msg, err)
+	}
+	glog.Errorf("Consul target %s: %s %s", cb.target, msg, err)
+}
+
+// setLastError records an error the caller handles, see LastError.
+func (cb *ConsulBackend) setLastError(msg string, err error) {
+	cb.lastError.Lock()
+	cb.lastError.msg = fmt.Sprint(msg, " ", err)
+	cb.lastError.at = time.Now()
+	cb.lastError.Unlock()
+}
+
+// LastError returns the last error of the backend and when it happened, the
+// zero time when there was none.
+func (cb *ConsulBackend) LastError() (string, time.Time) {
+	cb.lastError.Lock()
+	defer cb.lastError.Unlock()
+	return cb.lastError.msg, cb.lastError.at
+}
+
+// Ping tells if the agent of the backend answers.
+func (cb *ConsulBackend) Ping() error {
+	var leader string
+	_, err := cb.client.Raw().Query("/v1/status/leader", &leader, nil)
+	return err
+}
+
 func (cb *ConsulBackend) PutKV(key, value string) {
 	kv := cb.client.KV()
 	p := &consulapi.KVPair{Key: key, Value: []byte(value)}
 	_, err := kv.Put(p, nil)
 	if err != nil {
-		glog.Fatalln("Cannot add value in Consul:", err)
+		cb.fail("Cannot add value in Consul:", err)
 	}
 }
 
+// SetKV writes a value, returning the error instead of failing.
+func (cb *ConsulBackend) SetKV(key string, value []byte) error {
+	_, err := cb.client.KV().Put(&consulapi.KVPair{Key: key, Value: value}, nil)
+	return err
+}
+
 func (cb *ConsulBackend) GetKV(key string) (*consulapi.KVPair, error) {
 	kv := cb.client.KV()
 	value, _, err := kv.Get(key, nil)
@@ -47,7 +143,26 @@ func (cb *ConsulBackend) DeleteKV(key string) {
 	kv := cb.client.KV()
 	_, err := kv.Delete(key, nil)
 	if err != nil {
-		glog.Fatalln("Cannot add value in Consul:", err)
+		cb.fail("Cannot add value in Consul:", err)
+	}
+}
+
+// WatchKV is a blocking query returning the values under a prefix once its
+// index is greater than waitIndex, or when the query times out.
+func (cb *ConsulBackend) WatchKV(prefix string, waitIndex uint64) (consulapi.KVPairs, uint64, error) {
+	kv := cb.client.KV()
+	values, meta, err := kv.List(prefix, &consulapi.QueryOptions{WaitIndex: waitIndex})
+	if err != nil {
+		return nil, 0, err
+	}
+	return values, meta.LastIndex, nil
+}
+
+func (cb *ConsulBackend) DeleteKVTree(prefix string) {
+	kv := cb.client.KV()
+	_, err := kv.DeleteTree(prefix, nil)
+	if err != nil {
+		cb.fail("Cannot delete values in Consul:", err)
 	}
 }
 
@@ -59,21 +174,79 @@ func (cb *ConsulBackend) ListKV(key string) consulapi.KVPairs {
 	return nil
 }
 
-// TODO: Utiliser les CatalogRegistration à la place ?
-// https://godoc.org/github.com/hashicorp/consul/api#CatalogRegistration
-func (cb *ConsulBackend) AddService(id, name, address string, port int, tags []string) {
-	agent := cb.client.Agent()
+// ServiceRegistration is the agent service registration. The vendored
+// consulapi.AgentServiceRegistration lacks the fields added by newer Consul
+// versions, so it is sent through the raw API.
+type ServiceRegistration struct {
+	Kind            string                    `json:",omitempty"`
+	ID              string                    `json:",omitempty"`
+	Name            string                    `json:",omitempty"`
+	Tags            []string                  `json:",omitempty"`
+	Port            int                       `json:",omitempty"`
+	Address         string                    `json:",omitempty"`
+	TaggedAddresses map[string]ServiceAddress `json:",omitempty"`
+	Meta            map[string]string         `json:",omitempty"`
+	Weights         *AgentWeights             `json:",omitempty"`
+	Proxy           *AgentServiceProxy        `json:",omitempty"`
+	Connect         *AgentServiceConnect      `json:",omitempty"`
+	Namespace       string                    `json:",omitempty"`
+	Partition       string                    `json:",omitempty"`
+}
 
-	service := &consulapi.AgentServiceRegistration{
-		ID:      id,
-		Name:    name,
-		Address: address,
-		Port:    port,
-		Tags:    tags,
-	}
+type ServiceAddress struct {
+	Address string
+	Port    int
+}
+
+// Kind of the sidecar proxies registrations
+const ServiceKindConnectProxy = "connect-proxy"
+
+// AgentServiceProxy is the configuration of a connect-proxy service.
+type AgentServiceProxy struct {
+	DestinationServiceName string                 `json:",omitempty"`
+	DestinationServiceID   string                 `json:",omitempty"`
+	LocalServiceAddress    string                 `json:",omitempty"`
+	LocalServicePort       int                    `json:",omitempty"`
+	Config                 map[string]interface{} `json:",omitempty"`
+	Upstreams              []Upstream             `json:",omitempty"`
+}
 
-	if err := agent.ServiceRegister(service); err != nil {
-		glog.Fatalln("Cannot register service:", err)
+type Upstream struct {
+	DestinationName string
+	Datacenter      string `json:",omitempty"`
+	LocalBindPort   int
+}
+
+type AgentServiceConnect struct {
+	Native bool
+}
+
+// AgentService is a service known by the agent, with the fields of
+// ServiceRegistration missing from consulapi.AgentService.
+type AgentService struct {
+	Kind            string
+	ID              string
+	Namespace       string
+	Partition       string
+	Service         string
+	Tags            []string
+	Port            int
+	Address         string
+	TaggedAddresses map[string]ServiceAddress
+	Meta            map[string]string
+	Weights         AgentWeights
+}
+
+type AgentWeights struct {
+	Passing int
+	Warning int
+}
+
+// TODO: Utiliser les CatalogRegistration à la place ?
+// https://godoc.org/github.com/hashicorp/consul/api#CatalogRegistration
+func (cb *ConsulBackend) AddService(service *ServiceRegistration) {
+	if _, err := cb.client.Raw().Write("/v1/agent/service/register", service, nil, nil); err != nil {
+		cb.fail("Cannot register service:", err)
 	}
 }
 
@@ -81,17 +254,25 @@ func (cb *ConsulBackend) RemoveService(serviceID string) {
 	agent := cb.client.Agent()
 
 	if err := agent.ServiceDeregister(serviceID); err != nil {
-		glog.Fatalln("Cannot deregister service:", err)
+		cb.fail("Cannot deregister service:", err)
 	}
 }
 
-func (cb *ConsulBackend) ListServices() map[string]*consulapi.AgentService {
-	agent := cb.client.Agent()
+func (cb *ConsulBackend) EnableServiceMaintenance(serviceID, reason string) error {
+	return cb.client.Agent().EnableServiceMaintenance(serviceID, reason)
+}
+
+func (cb *ConsulBackend) DisableServiceMaintenance(serviceID string) error {
+	return cb.client.Agent().DisableServiceMaintenance(serviceID)
+}
+
+func (cb *ConsulBackend) ListServices() map[string]*AgentService {
+	services := make(map[string]*AgentService)
 
-	if services, err := agent.Services(); err == nil {
+	if _, err := cb.client.Raw().Query("/v1/agent/services", &services, nil); err == nil {
 		return services
 	} else {
-		glog.Fatalln("Cannot deregister service:", err)
+		cb.fail("Cannot list services:", err)
 	}
 	return nil
 }
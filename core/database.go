@@ -9,20 +9,30 @@ import (
 	kclient "k8s.io/kubernetes/pkg/client/unversioned"
 )
 
-const updateInterval = time.Minute * 10
+const (
+	updateInterval = time.Minute * 10
+
+	// Lists younger than this are not refreshed, see Refresh
+	refreshInterval = time.Second * 10
+)
 
 type Database struct {
 	services  *kapi.ServiceList
-	endpoints *kapi.EndpointsList
+	endpoints []ServiceEndpoints
+
+	// Time the lists were requested
+	updated time.Time
 
-	kubeClient *kclient.Client
+	kubeClient     *kclient.Client
+	endpointSource EndpointSource
 
 	sync.Mutex
 }
 
-func NewDatabase(kubeURL string) *Database {
+func NewDatabase(kubeURL string, endpointSource EndpointSource) *Database {
 	return &Database{
-		kubeClient: getKubeClient(kubeURL),
+		kubeClient:     getKubeClient(kubeURL),
+		endpointSource: endpointSource,
 	}
 }
 
@@ -30,17 +40,50 @@ func (db *Database) UpdateDatabase() {
 	db.Lock()
 	defer db.Unlock()
 
+	db.update()
+}
+
+// Refresh updates the database unless it was updated recently, so that the
+// resyncs triggered between the periodic updates don't rebuild the services
+// from old lists, and the targets resyncing together list them once.
+func (db *Database) Refresh() {
+	db.Lock()
+	defer db.Unlock()
+
+	if time.Since(db.updated) >= refreshInterval {
+		db.update()
+	}
+}
+
+// update must be called with the lock held
+func (db *Database) update() {
+	start := time.Now()
+	listed := true
+
 	if services, err := db.kubeClient.Services(kapi.NamespaceAll).List(kapi.ListOptions{}); err == nil {
 		db.services = services
 	} else {
 		glog.Errorf("Cannot get service list: %s", err)
+		listed = false
 	}
 
-	if endpoints, err := db.kubeClient.Endpoints(kapi.NamespaceAll).List(kapi.ListOptions{}); err == nil {
+	if endpoints, err := db.endpointSource.List(); err == nil {
 		db.endpoints = endpoints
 	} else {
 		glog.Errorf("Cannot get endpoints list: %s", err)
+		listed = false
 	}
+
+	if listed {
+		db.updated = start
+	}
+}
+
+// Updated returns the time the lists of the database were requested.
+func (db *Database) Updated() time.Time {
+	db.Lock()
+	defer db.Unlock()
+	return db.updated
 }
 
 func (db *Database) ListServices() (services *kapi.ServiceList) {
@@ -50,25 +93,41 @@ func (db *Database) ListServices() (services *kapi.ServiceList) {
 	return services
 }
 
-func (db *Database) ListEndpoints() (endpoints *kapi.EndpointsList) {
+func (db *Database) ListEndpoints() (endpoints []ServiceEndpoints) {
 	db.Lock()
 	endpoints = db.endpoints
 	db.Unlock()
 	return endpoints
 }
 
-func (db *Database) GetEndpoints(name string) *kapi.Endpoints {
-	for _, ep := range db.ListEndpoints().Items {
-		if ep.Name == name {
+func (db *Database) GetEndpoints(namespace, name string) *ServiceEndpoints {
+	for _, ep := range db.ListEndpoints() {
+		if ep.Namespace == namespace && ep.Name == name {
 			return &ep
 		}
 	}
 	return nil
 }
 
-func (db *Database) StartWatching(ch chan struct{}) {
-	for range time.NewTicker(updateInterval).C {
+// StartWatching updates the database periodically and notifies ch after
+// each update, until done is closed.
+func (db *Database) StartWatching(ch chan struct{}, done <-chan struct{}) {
+	ticker := time.NewTicker(updateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
 		db.UpdateDatabase()
-		ch <- struct{}{}
+
+		select {
+		case ch <- struct{}{}:
+		case <-done:
+			return
+		}
 	}
 }
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+const (
+	EndpointsSource      = "endpoints"
+	EndpointSlicesSource = "endpointslices"
+)
+
+// ServiceEndpoints groups all the addresses backing a Service, whatever the
+// Kubernetes object they were read from (Endpoints or EndpointSlices).
+type ServiceEndpoints struct {
+	unversioned.TypeMeta
+
+	Namespace string
+	Name      string
+	Subsets   []EndpointSubset
+}
+
+// EndpointSubset is a group of addresses sharing the same ports. An
+// Endpoints subset or an EndpointSlice each give one EndpointSubset.
+type EndpointSubset struct {
+	Addresses []EndpointAddress
+	Ports     []EndpointPort
+}
+
+type EndpointAddress struct {
+	IP        string
+	NodeName  string
+	Zone      string
+	TargetRef *kapi.ObjectReference
+
+	Ready       bool
+	Serving     bool
+	Terminating bool
+}
+
+type EndpointPort struct {
+	Name        string
+	Port        int
+	Protocol    kapi.Protocol
+	AppProtocol string
+}
+
+func (obj *ServiceEndpoints) GetObjectKind() unversioned.ObjectKind { return &obj.TypeMeta }
+
+// EndpointSource lists and watches the endpoints of every Service. Watch
+// events carry a *ServiceEndpoints.
+type EndpointSource interface {
+	List() ([]ServiceEndpoints, error)
+	Watch() (watch.Interface, error)
+}
+
+// NewEndpointSource returns the source of a kind of endpoint objects. A
+// source is shared by the Database and the KubeWatcher, so that the
+// EndpointSlices listed by one are aggregated with the events of the other.
+func NewEndpointSource(kubeURL, kind string) EndpointSource {
+	source, err := newEndpointSource(kind, getKubeClient(kubeURL))
+	if err != nil {
+		glog.Fatalln(err)
+	}
+	return source
+}
+
+func newEndpointSource(kind string, kubeClient *kclient.Client) (EndpointSource, error) {
+	switch kind {
+	case EndpointsSource:
+		return &endpointsSource{kubeClient: kubeClient}, nil
+	case EndpointSlicesSource:
+		return newEndpointSliceSource(kubeClient), nil
+	default:
+		return nil, fmt.Errorf("Unknown endpoint source '%s'", kind)
+	}
+}
+
+// endpointsSource reads the core/v1 Endpoints objects.
+type endpointsSource struct {
+	kubeClient *kclient.Client
+}
+
+func (s *endpointsSource) List() ([]ServiceEndpoints, error) {
+	endpoints, err := s.kubeClient.Endpoints(kapi.NamespaceAll).List(kapi.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]ServiceEndpoints, 0, len(endpoints.Items))
+	for _, ep := range endpoints.Items {
+		list = append(list, endpointsFromKube(ep))
+	}
+	return list, nil
+}
+
+func (s *endpointsSource) Watch() (watch.Interface, error) {
+	w, err := s.kubeClient.Endpoints(kapi.NamespaceAll).Watch(kapi.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return watch.Filter(w, func(in watch.Event) (watch.Event, bool) {
+		if ep, ok := in.Object.(*kapi.Endpoints); ok {
+			se := endpointsFromKube(*ep)
+			in.Object = &se
+		}
+		return in, true
+	}), nil
+}
+
+func endpointsFromKube(ep kapi.Endpoints) ServiceEndpoints {
+	se := ServiceEndpoints{
+		Namespace: ep.Namespace,
+		Name:      ep.Name,
+		Subsets:   make([]EndpointSubset, 0, len(ep.Subsets)),
+	}
+
+	for _, subset := range ep.Subsets {
+		s := EndpointSubset{
+			Addresses: make([]EndpointAddress, 0, len(subset.Addresses)+len(subset.NotReadyAddresses)),
+			Ports:     make([]EndpointPort, 0, len(subset.Ports)),
+		}
+
+		for _, addr := range subset.Addresses {
+			s.Addresses = append(s.Addresses, EndpointAddress{
+				IP:        addr.IP,
+				TargetRef: addr.TargetRef,
+				Ready:     true,
+				Serving:   true,
+			})
+		}
+		for _, addr := range subset.NotReadyAddresses {
+			s.Addresses = append(s.Addresses, EndpointAddress{
+				IP:        addr.IP,
+				TargetRef: addr.TargetRef,
+			})
+		}
+
+		for _, port := range subset.Ports {
+			s.Ports = append(s.Ports, EndpointPort{
+				Name:     port.Name,
+				Port:     port.Port,
+				Protocol: port.Protocol,
+			})
+		}
+
+		se.Subsets = append(se.Subsets, s)
+	}
+
+	return se
+}
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+const (
+	endpointSlicesPath = "/apis/discovery.k8s.io/v1/endpointslices"
+	serviceNameLabel   = "kubernetes.io/service-name"
+)
+
+// The vendored Kubernetes client predates discovery.k8s.io, so the
+// EndpointSlice objects are decoded in these minimal types.
+
+type EndpointSlice struct {
+	unversioned.TypeMeta
+
+	Metadata    sliceMeta       `json:"metadata"`
+	AddressType string          `json:"addressType"`
+	Endpoints   []sliceEndpoint `json:"endpoints"`
+	Ports       []slicePort     `json:"ports"`
+}
+
+type sliceMeta struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels"`
+}
+
+type sliceEndpoint struct {
+	Addresses  []string              `json:"addresses"`
+	Conditions sliceConditions       `json:"conditions"`
+	NodeName   *string               `json:"nodeName"`
+	Zone       *string               `json:"zone"`
+	TargetRef  *kapi.ObjectReference `json:"targetRef"`
+}
+
+type sliceConditions struct {
+	Ready       *bool `json:"ready"`
+	Serving     *bool `json:"serving"`
+	Terminating *bool `json:"terminating"`
+}
+
+type slicePort struct {
+	Name        *string `json:"name"`
+	Protocol    *string `json:"protocol"`
+	Port        *int    `json:"port"`
+	AppProtocol *string `json:"appProtocol"`
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []EndpointSlice `json:"items"`
+}
+
+func (obj *EndpointSlice) GetObjectKind() unversioned.ObjectKind { return &obj.TypeMeta }
+
+// endpointSliceSource aggregates the EndpointSlices of each Service into a
+// single ServiceEndpoints.
+type endpointSliceSource struct {
+	kubeClient *kclient.Client
+
+	// Service -> slice name -> slice
+	slices map[serviceRef]map[string]EndpointSlice
+
+	sync.Mutex
+}
+
+func newEndpointSliceSource(kubeClient *kclient.Client) *endpointSliceSource {
+	return &endpointSliceSource{
+		kubeClient: kubeClient,
+		slices:     make(map[serviceRef]map[string]EndpointSlice),
+	}
+}
+
+type serviceRef struct {
+	Namespace string
+	Name      string
+}
+
+// list replaces the cached slices with the current ones and returns the
+// resource version of the list.
+func (s *endpointSliceSource) list() (string, error) {
+	body, err := s.kubeClient.Get().AbsPath(endpointSlicesPath).DoRaw()
+	if err != nil {
+		return "", err
+	}
+
+	var list endpointSliceList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return "", err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.slices = make(map[serviceRef]map[string]EndpointSlice)
+	for _, slice := range list.Items {
+		s.store(slice)
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+func (s *endpointSliceSource) List() ([]ServiceEndpoints, error) {
+	if _, err := s.list(); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	endpoints := make([]ServiceEndpoints, 0, len(s.slices))
+	for ref := range s.slices {
+		endpoints = append(endpoints, s.aggregate(ref))
+	}
+	return endpoints, nil
+}
+
+// Watch lists the slices before watching them from the resource version of
+// the list, so that the event of a slice is aggregated with all the other
+// slices of its Service.
+func (s *endpointSliceSource) Watch() (watch.Interface, error) {
+	resourceVersion, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := s.kubeClient.Get().AbsPath(endpointSlicesPath).
+		Param("watch", "true").
+		Param("resourceVersion", resourceVersion).
+		Stream()
+	if err != nil {
+		return nil, err
+	}
+
+	w := watch.NewStreamWatcher(newStreamDecoder(stream, "EndpointSlice", func() runtime.Object {
+		return new(EndpointSlice)
+	}))
+
+	return watch.Filter(w, func(in watch.Event) (watch.Event, bool) {
+		slice, ok := in.Object.(*EndpointSlice)
+		if !ok {
+			return in, true
+		}
+
+		s.Lock()
+		defer s.Unlock()
+
+		ref, ok := sliceService(*slice)
+		if !ok {
+			return in, false
+		}
+
+		if in.Type == watch.Deleted {
+			delete(s.slices[ref], slice.Metadata.Name)
+		} else {
+			s.store(*slice)
+		}
+
+		se := s.aggregate(ref)
+		out := watch.Event{Type: watch.Modified, Object: &se}
+		if len(s.slices[ref]) == 0 {
+			delete(s.slices, ref)
+			out.Type = watch.Deleted
+		}
+		return out, true
+	}), nil
+}
+
+func sliceService(slice EndpointSlice) (serviceRef, bool) {
+	name, ok := slice.Metadata.Labels[serviceNameLabel]
+	if !ok || slice.AddressType == "FQDN" {
+		return serviceRef{}, false
+	}
+	return serviceRef{Namespace: slice.Metadata.Namespace, Name: name}, true
+}
+
+// store must be called with the lock held
+func (s *endpointSliceSource) store(slice EndpointSlice) {
+	ref, ok := sliceService(slice)
+	if !ok {
+		return
+	}
+
+	if _, ok := s.slices[ref]; !ok {
+		s.slices[ref] = make(map[string]EndpointSlice)
+	}
+	s.slices[ref][slice.Metadata.Name] = slice
+}
+
+// aggregate must be called with the lock held
+func (s *endpointSliceSource) aggregate(ref serviceRef) ServiceEndpoints {
+	slices := s.slices[ref]
+
+	names := make([]string, 0, len(slices))
+	for name := range slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	se := ServiceEndpoints{
+		Namespace: ref.Namespace,
+		Name:      ref.Name,
+		Subsets:   make([]EndpointSubset, 0, len(slices)),
+	}
+	for _, name := range names {
+		se.Subsets = append(se.Subsets, subsetFromSlice(slices[name]))
+	}
+	return se
+}
+
+func subsetFromSlice(slice EndpointSlice) EndpointSubset {
+	subset := EndpointSubset{
+		Addresses: make([]EndpointAddress, 0, len(slice.Endpoints)),
+		Ports:     make([]EndpointPort, 0, len(slice.Ports)),
+	}
+
+	for _, ep := range slice.Endpoints {
+		// A nil condition means unknown: ready defaults to true, serving
+		// follows ready and terminating defaults to false.
+		ready := ep.Conditions.Ready == nil || *ep.Conditions.Ready
+		serving := ready
+		if ep.Conditions.Serving != nil {
+			serving = *ep.Conditions.Serving
+		}
+		terminating := ep.Conditions.Terminating != nil && *ep.Conditions.Terminating
+
+		for _, ip := range ep.Addresses {
+			subset.Addresses = append(subset.Addresses, EndpointAddress{
+				IP:          ip,
+				NodeName:    stringValue(ep.NodeName),
+				Zone:        stringValue(ep.Zone),
+				TargetRef:   ep.TargetRef,
+				Ready:       ready,
+				Serving:     serving,
+				Terminating: terminating,
+			})
+		}
+	}
+
+	for _, port := range slice.Ports {
+		p := EndpointPort{
+			Name:        stringValue(port.Name),
+			Protocol:    kapi.ProtocolTCP,
+			AppProtocol: stringValue(port.AppProtocol),
+		}
+		if port.Port != nil {
+			p.Port = *port.Port
+		}
+		if port.Protocol != nil {
+			p.Protocol = kapi.Protocol(*port.Protocol)
+		}
+		subset.Ports = append(subset.Ports, p)
+	}
+
+	return subset
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,371 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	agentCheckInterval = time.Second * 10
+	agentPingTimeout   = time.Second * 5
+)
+
+// agentPool is the set of Consul agents a backend can talk to. The requests
+// go to the current agent until it stops answering, then to the next agent
+// that is up.
+type agentPool struct {
+	// Addresses as given, the host names being resolved to all their
+	// addresses
+	entries []string
+	scheme  string
+	base    http.RoundTripper
+
+	agents  []string
+	current string
+	down    map[string]bool
+
+	// Callbacks by registration, see OnAgentChange and OnAgentReturn
+	onChange  map[int]func(previous, current string)
+	onReturn  map[int]func(address string)
+	callbacks int
+
+	// Closed to stop the check of the agents, see ConsulBackend.Close
+	done      chan struct{}
+	closeOnce sync.Once
+
+	sync.Mutex
+}
+
+// splitAgents reads a list of agents separated by commas or by pipes, the
+// latter being usable in the Consul targets.
+func splitAgents(consulAPI string) []string {
+	return strings.FieldsFunc(consulAPI, func(r rune) bool {
+		return r == ',' || r == '|' || r == ' '
+	})
+}
+
+func newAgentPool(entries []string, scheme string, base http.RoundTripper) *agentPool {
+	p := &agentPool{
+		entries:  entries,
+		scheme:   scheme,
+		base:     base,
+		down:     make(map[string]bool),
+		onChange: make(map[int]func(previous, current string)),
+		onReturn: make(map[int]func(address string)),
+		done:     make(chan struct{}),
+	}
+	p.resolve()
+	if len(p.agents) > 0 {
+		p.current = p.agents[0]
+	}
+	return p
+}
+
+// resolve expands the host names of the entries into the addresses of their
+// agents. A name that doesn't resolve is kept as is so that the HTTP client
+// reports the error.
+func (p *agentPool) resolve() {
+	agents := make([]string, 0, len(p.entries))
+	seen := make(map[string]bool)
+
+	for _, entry := range p.entries {
+		addresses := []string{entry}
+
+		if host, port, err := net.SplitHostPort(entry); err == nil && net.ParseIP(host) == nil {
+			if ips, err := net.LookupHost(host); err == nil && len(ips) > 1 {
+				addresses = addresses[:0]
+				for _, ip := range ips {
+					addresses = append(addresses, net.JoinHostPort(ip, port))
+				}
+			}
+		}
+
+		for _, address := range addresses {
+			if !seen[address] {
+				seen[address] = true
+				agents = append(agents, address)
+			}
+		}
+	}
+
+	p.Lock()
+	p.agents = agents
+	p.Unlock()
+}
+
+func (p *agentPool) Current() string {
+	p.Lock()
+	defer p.Unlock()
+	return p.current
+}
+
+// markDown records that an agent doesn't answer, and switches to the next
+// agent that is up when it was the current one. It returns false when
+// there is no agent left.
+func (p *agentPool) markDown(address string) bool {
+	p.Lock()
+
+	if !p.down[address] {
+		glog.Errorf("Consul agent %s is down", address)
+	}
+	p.down[address] = true
+
+	if address != p.current {
+		p.Unlock()
+		return !p.down[p.current]
+	}
+
+	next := ""
+	for i, agent := range p.agents {
+		if agent == address {
+			for j := 1; j < len(p.agents); j++ {
+				candidate := p.agents[(i+j)%len(p.agents)]
+				if !p.down[candidate] {
+					next = candidate
+					break
+				}
+			}
+			break
+		}
+	}
+	if next == "" {
+		for _, agent := range p.agents {
+			if !p.down[agent] {
+				next = agent
+				break
+			}
+		}
+	}
+	if next == "" {
+		p.Unlock()
+		return false
+	}
+
+	p.current = next
+	callbacks := make([]func(previous, current string), 0, len(p.onChange))
+	for _, f := range p.onChange {
+		callbacks = append(callbacks, f)
+	}
+	p.Unlock()
+
+	glog.Infof("Fail over from Consul agent %s to %s", address, next)
+	for _, f := range callbacks {
+		go f(address, next)
+	}
+	return true
+}
+
+// ping tells if an agent answers, bypassing the failover.
+func (p *agentPool) ping(address string) error {
+	req, err := http.NewRequest("GET", p.scheme+"://"+address+"/v1/status/leader", nil)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), agentPingTimeout)
+	defer cancel()
+
+	resp, err := p.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// check resolves the entries again and follows the agents that are down,
+// reporting those that answer again, until the pool is closed.
+func (p *agentPool) check() {
+	ticker := time.NewTicker(agentCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+
+		p.resolve()
+
+		p.Lock()
+		down := make([]string, 0, len(p.down))
+		for address := range p.down {
+			down = append(down, address)
+		}
+		p.Unlock()
+
+		for _, address := range down {
+			if p.ping(address) != nil {
+				continue
+			}
+
+			glog.Infof("Consul agent %s is back", address)
+
+			p.Lock()
+			delete(p.down, address)
+			previous := p.current
+			if p.down[previous] {
+				p.current = address
+			}
+			current := p.current
+			onChange := make([]func(previous, current string), 0, len(p.onChange))
+			for _, f := range p.onChange {
+				onChange = append(onChange, f)
+			}
+			onReturn := make([]func(address string), 0, len(p.onReturn))
+			for _, f := range p.onReturn {
+				onReturn = append(onReturn, f)
+			}
+			p.Unlock()
+
+			if address == current {
+				if previous != current {
+					glog.Infof("Fail over from Consul agent %s to %s", previous, current)
+					for _, f := range onChange {
+						go f(previous, current)
+					}
+				}
+				continue
+			}
+			for _, f := range onReturn {
+				f(address)
+			}
+		}
+	}
+}
+
+// failoverTransport sends the requests to the current agent of the pool,
+// retrying them on the next agent when it doesn't answer.
+type failoverTransport struct {
+	pool *agentPool
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for {
+		address := t.pool.Current()
+
+		u := *req.URL
+		u.Host = address
+		r := *req
+		r.URL = &u
+		r.Host = address
+
+		resp, err := t.pool.base.RoundTrip(&r)
+		if err == nil || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		// The request can only be sent again when its body can be read
+		// again
+		if req.Body != nil && req.GetBody == nil {
+			t.pool.markDown(address)
+			return nil, err
+		}
+		if !t.pool.markDown(address) {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (p *agentPool) close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+// Close stops following the agents of the backend, and of its scopes which
+// share them. The backend mustn't be used afterwards.
+func (cb *ConsulBackend) Close() {
+	if cb.agents != nil {
+		cb.agents.close()
+	}
+}
+
+// Agent returns the address of the agent the backend talks to.
+func (cb *ConsulBackend) Agent() string {
+	if cb.agents == nil {
+		return cb.config.Address
+	}
+	return cb.agents.Current()
+}
+
+// OnAgentChange calls f after the backend failed over to another agent.
+// The agent registrations being local to an agent, they have to be written
+// again. The returned function stops calling f.
+func (cb *ConsulBackend) OnAgentChange(f func(previous, current string)) (unregister func()) {
+	if cb.agents == nil {
+		return func() {}
+	}
+
+	p := cb.agents
+	p.Lock()
+	defer p.Unlock()
+
+	p.callbacks++
+	id := p.callbacks
+	p.onChange[id] = f
+
+	return func() {
+		p.Lock()
+		delete(p.onChange, id)
+		p.Unlock()
+	}
+}
+
+// OnAgentReturn calls f with a backend bound to an agent that answers again
+// after the backend failed over from it, so that the registrations left on
+// it can be removed. The returned function stops calling f.
+func (cb *ConsulBackend) OnAgentReturn(f func(agent *ConsulBackend)) (unregister func()) {
+	if cb.agents == nil {
+		return func() {}
+	}
+
+	p := cb.agents
+	p.Lock()
+	defer p.Unlock()
+
+	p.callbacks++
+	id := p.callbacks
+	p.onReturn[id] = func(address string) {
+		f(cb.pinned(address))
+	}
+
+	return func() {
+		p.Lock()
+		delete(p.onReturn, id)
+		p.Unlock()
+	}
+}
+
+// pinned returns a backend talking to a single agent of the pool.
+func (cb *ConsulBackend) pinned(address string) *ConsulBackend {
+	config := *cb.config
+	config.Address = address
+	config.HttpClient = &http.Client{Transport: cb.agents.base, Timeout: cb.config.HttpClient.Timeout}
+
+	client, err := consulapi.NewClient(&config)
+	if err != nil {
+		glog.Fatalln(err)
+	}
+
+	// The errors of the agent left don't concern the current one
+	target := cb.target
+	if target == "" {
+		target = address
+	}
+
+	return &ConsulBackend{client: client, config: &config, target: target, scopes: make(map[Scope]*ConsulBackend), session: &kvSession{}, lastError: &backendError{}}
+}
@@ -1,55 +1,119 @@
 package api
 
 import (
+	"time"
+
 	"github.com/golang/glog"
 	kapi "k8s.io/kubernetes/pkg/api"
 	kclient "k8s.io/kubernetes/pkg/client/unversioned"
 	"k8s.io/kubernetes/pkg/watch"
 )
 
+const subscriberQueueSize = 1024
+
 type KubeWatcher struct {
 	subscribers []Subscriber
 
-	kubeClient *kclient.Client
+	kubeClient     *kclient.Client
+	endpointSource EndpointSource
+
+	// Closed to stop watching
+	done <-chan struct{}
 }
 
 type Subscriber struct {
 	ch chan watch.Event
 }
 
-func NewKubeWatcher(kubeURL string) *KubeWatcher {
+// NewKubeWatcher returns a watcher forwarding the service and endpoint
+// events to its subscribers until done is closed.
+func NewKubeWatcher(kubeURL string, endpointSource EndpointSource, done <-chan struct{}) *KubeWatcher {
 	return &KubeWatcher{
-		kubeClient: getKubeClient(kubeURL),
+		kubeClient:     getKubeClient(kubeURL),
+		endpointSource: endpointSource,
+		done:           done,
 	}
 }
 
 func (kw *KubeWatcher) Start() {
 	glog.Info("Start watching events")
 
-	wsvc, _ := kw.kubeClient.Services(kapi.NamespaceAll).Watch(kapi.ListOptions{})
-	wep, _ := kw.kubeClient.Endpoints(kapi.NamespaceAll).Watch(kapi.ListOptions{})
-
 	events := make(chan watch.Event)
 
-	go func() {
-		for {
+	go kw.watch("services", func() (watch.Interface, error) {
+		return kw.kubeClient.Services(kapi.NamespaceAll).Watch(kapi.ListOptions{})
+	}, events)
+	go kw.watch("endpoints", kw.endpointSource.Watch, events)
+
+	for {
+		select {
+		case event := <-events:
+			for _, subscriber := range kw.subscribers {
+				select {
+				case subscriber.ch <- event:
+				case <-kw.done:
+				}
+			}
+		case <-kw.done:
+			// Ends the forwarding to the subscribers
+			for _, subscriber := range kw.subscribers {
+				close(subscriber.ch)
+			}
+			return
+		}
+	}
+}
+
+// watch sends the events of a watch to events, and starts it again when it
+// fails or ends, until the watcher is done.
+func (kw *KubeWatcher) watch(kind string, start func() (watch.Interface, error), events chan<- watch.Event) {
+	for {
+		w, err := start()
+		if err != nil {
+			glog.Errorf("Cannot watch %s: %s", kind, err)
 			select {
-			case ev := <-wsvc.ResultChan():
-				events <- ev
-			case ev := <-wep.ResultChan():
-				events <- ev
+			case <-time.After(watchRetryInterval):
+				continue
+			case <-kw.done:
+				return
 			}
 		}
-	}()
 
-	// TODO: fix bug boucle infini !
-	for event := range events {
-		for _, subscriber := range kw.subscribers {
-			subscriber.ch <- event
+		for ended := false; !ended; {
+			select {
+			case event, ok := <-w.ResultChan():
+				if !ok {
+					ended = true
+					break
+				}
+				select {
+				case events <- event:
+				case <-kw.done:
+					w.Stop()
+					return
+				}
+			case <-kw.done:
+				w.Stop()
+				return
+			}
 		}
 	}
 }
 
+// Subscribe forwards the events to ch. Events are queued per subscriber so
+// that a slow subscriber, such as the plugins of a Consul target that is
+// down, doesn't delay the others.
 func (kw *KubeWatcher) Subscribe(ch chan watch.Event) {
-	kw.subscribers = append(kw.subscribers, Subscriber{ch: ch})
+	queue := make(chan watch.Event, subscriberQueueSize)
+	go func() {
+		for event := range queue {
+			select {
+			case ch <- event:
+			case <-kw.done:
+				return
+			}
+		}
+	}()
+
+	kw.subscribers = append(kw.subscribers, Subscriber{ch: queue})
 }
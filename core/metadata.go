@@ -0,0 +1,287 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+const (
+	watchRetryInterval = time.Second * 5
+
+	LabelTopologyZone   = "topology.kubernetes.io/zone"
+	LabelTopologyRegion = "topology.kubernetes.io/region"
+)
+
+// MetadataStore caches pods, nodes and namespaces so that endpoints can be
+// enriched and selectors resolved without an API call per event.
+type MetadataStore struct {
+	pods       map[string]kapi.Pod
+	nodes      map[string]kapi.Node
+	namespaces map[string]kapi.Namespace
+
+	subscribers []Subscriber
+
+	kubeClient *kclient.Client
+	once       sync.Once
+
+	// Closed to stop watching
+	done <-chan struct{}
+
+	sync.Mutex
+}
+
+// NewMetadataStore returns a store kept up to date from its start until
+// done is closed.
+func NewMetadataStore(kubeURL string, done <-chan struct{}) *MetadataStore {
+	return &MetadataStore{
+		pods:       make(map[string]kapi.Pod),
+		nodes:      make(map[string]kapi.Node),
+		namespaces: make(map[string]kapi.Namespace),
+		kubeClient: getKubeClient(kubeURL),
+		done:       done,
+	}
+}
+
+// Start fills the store and keeps it up to date. It can be called by every
+// plugin needing the store, only the first call has an effect.
+func (ms *MetadataStore) Start() {
+	ms.once.Do(func() {
+		glog.Info("Start caching pods, nodes and namespaces")
+
+		ms.listPods()
+		ms.listNodes()
+		ms.listNamespaces()
+
+		go ms.watch("pods", func() (watch.Interface, error) {
+			return ms.kubeClient.Pods(kapi.NamespaceAll).Watch(kapi.ListOptions{})
+		}, ms.listPods)
+
+		go ms.watch("nodes", func() (watch.Interface, error) {
+			return ms.kubeClient.Nodes().Watch(kapi.ListOptions{})
+		}, ms.listNodes)
+
+		go ms.watch("namespaces", func() (watch.Interface, error) {
+			return ms.kubeClient.Namespaces().Watch(kapi.ListOptions{})
+		}, ms.listNamespaces)
+	})
+}
+
+func podKey(namespace, name string) string {
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
+
+func (ms *MetadataStore) listPods() {
+	pods, err := ms.kubeClient.Pods(kapi.NamespaceAll).List(kapi.ListOptions{})
+	if err != nil {
+		glog.Errorf("Cannot get pod list: %s", err)
+		return
+	}
+
+	ms.Lock()
+	ms.pods = make(map[string]kapi.Pod, len(pods.Items))
+	for _, pod := range pods.Items {
+		ms.pods[podKey(pod.Namespace, pod.Name)] = pod
+	}
+	ms.Unlock()
+}
+
+func (ms *MetadataStore) listNodes() {
+	nodes, err := ms.kubeClient.Nodes().List(kapi.ListOptions{})
+	if err != nil {
+		glog.Errorf("Cannot get node list: %s", err)
+		return
+	}
+
+	ms.Lock()
+	ms.nodes = make(map[string]kapi.Node, len(nodes.Items))
+	for _, node := range nodes.Items {
+		ms.nodes[node.Name] = node
+	}
+	ms.Unlock()
+}
+
+func (ms *MetadataStore) listNamespaces() {
+	namespaces, err := ms.kubeClient.Namespaces().List(kapi.ListOptions{})
+	if err != nil {
+		glog.Errorf("Cannot get namespace list: %s", err)
+		return
+	}
+
+	ms.Lock()
+	ms.namespaces = make(map[string]kapi.Namespace, len(namespaces.Items))
+	for _, namespace := range namespaces.Items {
+		ms.namespaces[namespace.Name] = namespace
+	}
+	ms.Unlock()
+}
+
+// watch applies the events of a watch to the store, and relists the objects
+// each time the watch ends so that no event is missed, until the store is
+// done.
+func (ms *MetadataStore) watch(kind string, start func() (watch.Interface, error), relist func()) {
+	for {
+		w, err := start()
+		if err != nil {
+			glog.Errorf("Cannot watch %s: %s", kind, err)
+			select {
+			case <-time.After(watchRetryInterval):
+				continue
+			case <-ms.done:
+				return
+			}
+		}
+
+		if !ms.forward(w) {
+			w.Stop()
+			return
+		}
+
+		relist()
+	}
+}
+
+// forward applies the events of a watch and forwards them to the
+// subscribers until the watch ends. It returns false when the store is done.
+func (ms *MetadataStore) forward(w watch.Interface) bool {
+	for {
+		var event watch.Event
+		select {
+		case e, ok := <-w.ResultChan():
+			if !ok {
+				return true
+			}
+			event = e
+		case <-ms.done:
+			return false
+		}
+
+		ms.handleEvent(event)
+
+		ms.Lock()
+		subscribers := ms.subscribers
+		ms.Unlock()
+
+		for _, subscriber := range subscribers {
+			select {
+			case subscriber.ch <- event:
+			case <-ms.done:
+				return false
+			}
+		}
+	}
+}
+
+func (ms *MetadataStore) handleEvent(event watch.Event) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	switch obj := event.Object.(type) {
+	case *kapi.Pod:
+		if event.Type == watch.Deleted {
+			delete(ms.pods, podKey(obj.Namespace, obj.Name))
+		} else {
+			ms.pods[podKey(obj.Namespace, obj.Name)] = *obj
+		}
+	case *kapi.Node:
+		if event.Type == watch.Deleted {
+			delete(ms.nodes, obj.Name)
+		} else {
+			ms.nodes[obj.Name] = *obj
+		}
+	case *kapi.Namespace:
+		if event.Type == watch.Deleted {
+			delete(ms.namespaces, obj.Name)
+		} else {
+			ms.namespaces[obj.Name] = *obj
+		}
+	}
+}
+
+// Subscribe forwards the pod, node and namespace events to ch once they are
+// applied to the store. Events are queued per subscriber, as the ones of
+// the KubeWatcher, so that a slow subscriber doesn't delay the store and
+// the others.
+func (ms *MetadataStore) Subscribe(ch chan watch.Event) {
+	queue := make(chan watch.Event, subscriberQueueSize)
+	go func() {
+		for {
+			select {
+			case event := <-queue:
+				select {
+				case ch <- event:
+				case <-ms.done:
+					return
+				}
+			case <-ms.done:
+				return
+			}
+		}
+	}()
+
+	ms.Lock()
+	ms.subscribers = append(ms.subscribers, Subscriber{ch: queue})
+	ms.Unlock()
+}
+
+func (ms *MetadataStore) GetPod(namespace, name string) (pod kapi.Pod, ok bool) {
+	ms.Lock()
+	pod, ok = ms.pods[podKey(namespace, name)]
+	ms.Unlock()
+	return pod, ok
+}
+
+func (ms *MetadataStore) GetNode(name string) (node kapi.Node, ok bool) {
+	ms.Lock()
+	node, ok = ms.nodes[name]
+	ms.Unlock()
+	return node, ok
+}
+
+// ListPods returns the pods of a namespace, or of every namespace with
+// kapi.NamespaceAll.
+func (ms *MetadataStore) ListPods(namespace string) []kapi.Pod {
+	ms.Lock()
+	defer ms.Unlock()
+
+	pods := make([]kapi.Pod, 0)
+	for _, pod := range ms.pods {
+		if namespace == kapi.NamespaceAll || pod.Namespace == namespace {
+			pods = append(pods, pod)
+		}
+	}
+	return pods
+}
+
+func (ms *MetadataStore) ListNamespaces() []kapi.Namespace {
+	ms.Lock()
+	defer ms.Unlock()
+
+	namespaces := make([]kapi.Namespace, 0, len(ms.namespaces))
+	for _, namespace := range ms.namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	return namespaces
+}
+
+// NodeTopology returns the zone and region of a node, from the topology
+// labels or their deprecated failure-domain equivalents.
+func NodeTopology(node kapi.Node) (zone, region string) {
+	zone = node.Labels[LabelTopologyZone]
+	if zone == "" {
+		zone = node.Labels[unversioned.LabelZoneFailureDomain]
+	}
+
+	region = node.Labels[LabelTopologyRegion]
+	if region == "" {
+		region = node.Labels[unversioned.LabelZoneRegion]
+	}
+
+	return zone, region
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/json"
+
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util/intstr"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+const networkPoliciesPath = "/apis/networking.k8s.io/v1/networkpolicies"
+
+const (
+	PolicyTypeIngress = "Ingress"
+	PolicyTypeEgress  = "Egress"
+)
+
+// The vendored Kubernetes client predates networking.k8s.io/v1, so the
+// NetworkPolicy objects are decoded in these minimal types.
+
+type NetworkPolicy struct {
+	unversioned.TypeMeta
+
+	Metadata policyMeta        `json:"metadata"`
+	Spec     NetworkPolicySpec `json:"spec"`
+}
+
+type policyMeta struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+type NetworkPolicySpec struct {
+	PodSelector LabelSelector       `json:"podSelector"`
+	Ingress     []NetworkPolicyRule `json:"ingress"`
+	Egress      []NetworkPolicyRule `json:"egress"`
+	PolicyTypes []string            `json:"policyTypes"`
+}
+
+// NetworkPolicyRule is an ingress or egress rule, whose peers are in From
+// or To.
+type NetworkPolicyRule struct {
+	From  []NetworkPolicyPeer `json:"from"`
+	To    []NetworkPolicyPeer `json:"to"`
+	Ports []NetworkPolicyPort `json:"ports"`
+}
+
+type NetworkPolicyPeer struct {
+	PodSelector       *LabelSelector `json:"podSelector"`
+	NamespaceSelector *LabelSelector `json:"namespaceSelector"`
+	IPBlock           *IPBlock       `json:"ipBlock"`
+}
+
+type IPBlock struct {
+	CIDR   string   `json:"cidr"`
+	Except []string `json:"except"`
+}
+
+type NetworkPolicyPort struct {
+	Protocol *string             `json:"protocol"`
+	Port     *intstr.IntOrString `json:"port"`
+	EndPort  *int                `json:"endPort"`
+}
+
+type networkPolicyList struct {
+	Items []NetworkPolicy `json:"items"`
+}
+
+func (obj *NetworkPolicy) GetObjectKind() unversioned.ObjectKind { return &obj.TypeMeta }
+
+// HasPolicyType tells if a policy applies to ingress or egress traffic. A
+// policy without types applies to ingress, and to egress when it has egress
+// rules.
+func (np *NetworkPolicy) HasPolicyType(policyType string) bool {
+	if len(np.Spec.PolicyTypes) == 0 {
+		return policyType == PolicyTypeIngress || len(np.Spec.Egress) > 0
+	}
+
+	for _, t := range np.Spec.PolicyTypes {
+		if t == policyType {
+			return true
+		}
+	}
+	return false
+}
+
+// NetworkPolicySource lists and watches the NetworkPolicies of every
+// namespace.
+type NetworkPolicySource struct {
+	kubeClient *kclient.Client
+}
+
+func NewNetworkPolicySource(kubeURL string) *NetworkPolicySource {
+	return &NetworkPolicySource{kubeClient: getKubeClient(kubeURL)}
+}
+
+func (s *NetworkPolicySource) List() ([]NetworkPolicy, error) {
+	body, err := s.kubeClient.Get().AbsPath(networkPoliciesPath).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	var list networkPolicyList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (s *NetworkPolicySource) Watch() (watch.Interface, error) {
+	stream, err := s.kubeClient.Get().AbsPath(networkPoliciesPath).Param("watch", "true").Stream()
+	if err != nil {
+		return nil, err
+	}
+
+	return watch.NewStreamWatcher(newStreamDecoder(stream, "NetworkPolicy", func() runtime.Object {
+		return new(NetworkPolicy)
+	})), nil
+}
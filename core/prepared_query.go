@@ -0,0 +1,51 @@
+package api
+
+// PreparedQuery is a prepared query of a service. Prepared queries are
+// missing from the vendored consulapi, so they are sent through the raw API.
+type PreparedQuery struct {
+	ID      string `json:",omitempty"`
+	Name    string
+	Service ServiceQuery
+}
+
+// ServiceQuery is the service of a prepared query. Prepared queries aren't
+// scoped, the Consul Enterprise namespace and partition of the service are
+// part of the query.
+type ServiceQuery struct {
+	Service     string
+	Namespace   string `json:",omitempty"`
+	Partition   string `json:",omitempty"`
+	Failover    QueryFailover
+	OnlyPassing bool
+	Near        string   `json:",omitempty"`
+	Tags        []string `json:",omitempty"`
+}
+
+type QueryFailover struct {
+	NearestN    int
+	Datacenters []string `json:",omitempty"`
+}
+
+func (cb *ConsulBackend) ListPreparedQueries() ([]PreparedQuery, error) {
+	queries := make([]PreparedQuery, 0)
+	_, err := cb.client.Raw().Query("/v1/query", &queries, nil)
+	return queries, err
+}
+
+// CreatePreparedQuery creates a prepared query and returns its ID.
+func (cb *ConsulBackend) CreatePreparedQuery(query PreparedQuery) (string, error) {
+	var out struct {
+		ID string
+	}
+	err := cb.rawRequest("POST", "/v1/query", query, &out)
+	return out.ID, err
+}
+
+func (cb *ConsulBackend) UpdatePreparedQuery(query PreparedQuery) error {
+	_, err := cb.client.Raw().Write("/v1/query/"+query.ID, query, nil, nil)
+	return err
+}
+
+func (cb *ConsulBackend) DeletePreparedQuery(id string) error {
+	return cb.rawDelete("/v1/query/" + id)
+}
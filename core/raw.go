@@ -0,0 +1,55 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// rawRequest sends a request with a method the vendored consulapi.Raw lacks.
+// in and out are encoded and decoded in JSON when they are not nil.
+func (cb *ConsulBackend) rawRequest(method, endpoint string, in, out interface{}) error {
+	u := &url.URL{Scheme: cb.config.Scheme, Host: cb.config.Address, Path: endpoint}
+	if cb.config.Token != "" {
+		u.RawQuery = url.Values{"token": []string{cb.config.Token}}.Encode()
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if auth := cb.config.HttpAuth; auth != nil {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	resp, err := cb.config.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Unexpected response code: %d", resp.StatusCode)
+	}
+
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func (cb *ConsulBackend) rawDelete(endpoint string) error {
+	return cb.rawRequest("DELETE", endpoint, nil, nil)
+}
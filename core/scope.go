@@ -0,0 +1,92 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Namespace of the agent queries listing every namespace
+const WildcardNamespace = "*"
+
+// Scope is a Consul Enterprise namespace and admin partition. The empty
+// scope is the default one, the only one of Consul OSS.
+type Scope struct {
+	Namespace string
+	Partition string
+}
+
+// scopeTransport adds the scope to every request, the vendored consulapi
+// predating Consul Enterprise namespaces.
+type scopeTransport struct {
+	scope Scope
+	base  http.RoundTripper
+}
+
+func (t *scopeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	query := u.Query()
+	if t.scope.Namespace != "" {
+		query.Set("ns", t.scope.Namespace)
+	}
+	if t.scope.Partition != "" {
+		query.Set("partition", t.scope.Partition)
+	}
+	u.RawQuery = query.Encode()
+
+	r := *req
+	r.URL = &u
+	return t.base.RoundTrip(&r)
+}
+
+// Scoped returns a backend whose requests are made in a scope.
+func (cb *ConsulBackend) Scoped(scope Scope) *ConsulBackend {
+	if scope == (Scope{}) {
+		return cb
+	}
+
+	cb.scopesLock.Lock()
+	defer cb.scopesLock.Unlock()
+
+	if scoped, ok := cb.scopes[scope]; ok {
+		return scoped
+	}
+
+	base := cb.config.HttpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	config := *cb.config
+	config.HttpClient = &http.Client{
+		Transport: &scopeTransport{scope: scope, base: base},
+		Timeout:   cb.config.HttpClient.Timeout,
+	}
+
+	client, err := consulapi.NewClient(&config)
+	if err != nil {
+		glog.Fatalln(err)
+	}
+
+	scoped := &ConsulBackend{client: client, config: &config, target: cb.target, agents: cb.agents, session: cb.session, lastError: cb.lastError}
+	cb.scopes[scope] = scoped
+	return scoped
+}
+
+// ListNamespaces returns the Consul Enterprise namespaces of the partition
+// of the backend.
+func (cb *ConsulBackend) ListNamespaces() ([]string, error) {
+	var namespaces []struct {
+		Name string
+	}
+	if _, err := cb.client.Raw().Query("/v1/namespaces", &namespaces, nil); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		names = append(names, ns.Name)
+	}
+	return names, nil
+}
@@ -0,0 +1,68 @@
+package api
+
+const (
+	LabelSelectorOpIn           = "In"
+	LabelSelectorOpNotIn        = "NotIn"
+	LabelSelectorOpExists       = "Exists"
+	LabelSelectorOpDoesNotExist = "DoesNotExist"
+)
+
+// LabelSelector is a label query. The vendored Kubernetes client only knows
+// the selectors of the old API groups.
+type LabelSelector struct {
+	MatchLabels      map[string]string          `json:"matchLabels"`
+	MatchExpressions []LabelSelectorRequirement `json:"matchExpressions"`
+}
+
+type LabelSelectorRequirement struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values"`
+}
+
+// Matches tells if labels match the selector, an empty selector matching
+// everything.
+func (s *LabelSelector) Matches(labels map[string]string) bool {
+	for key, value := range s.MatchLabels {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+
+	for _, req := range s.MatchExpressions {
+		value, ok := labels[req.Key]
+
+		switch req.Operator {
+		case LabelSelectorOpIn:
+			if !ok || !containsString(req.Values, value) {
+				return false
+			}
+		case LabelSelectorOpNotIn:
+			if ok && containsString(req.Values, value) {
+				return false
+			}
+		case LabelSelectorOpExists:
+			if !ok {
+				return false
+			}
+		case LabelSelectorOpDoesNotExist:
+			if ok {
+				return false
+			}
+		default:
+			// An unknown operator selects nothing
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsString(slice []string, value string) bool {
+	for _, s := range slice {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"errors"
+	"sync"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// TTL of the sessions created by kube2consul, renewed at half of it
+const SessionTTL = "15s"
+
+// ErrNoSession is returned when the KV of a backend must be bound to a
+// session that isn't created yet.
+var ErrNoSession = errors.New("KV session not created yet")
+
+// kvSession is the session the KV of a backend are bound to, shared by the
+// backend and its scopes.
+type kvSession struct {
+	id string
+
+	// Set once the KV are bound to a session, they are not written without
+	// one afterwards
+	required bool
+
+	// Session created by RetrySession, see BindSession
+	binding *sessionBinding
+
+	sync.Mutex
+}
+
+type sessionBinding struct {
+	name     string
+	behavior string
+	done     chan struct{}
+}
+
+// UseSession binds the KV written with the session of the backend to an
+// existing session, such as the leader one. An empty id unbinds them, and
+// the KV are refused until the backend is bound to a session again.
+func (cb *ConsulBackend) UseSession(id string) {
+	cb.session.Lock()
+	cb.session.id = id
+	cb.session.required = cb.session.required || id != ""
+	cb.session.Unlock()
+}
+
+// Session returns the session the KV of the backend are bound to, empty
+// when there is none.
+func (cb *ConsulBackend) Session() string {
+	cb.session.Lock()
+	defer cb.session.Unlock()
+	return cb.session.id
+}
+
+// CreateSession creates a session with the given behavior, renewed until
+// done is closed and then destroyed.
+func (cb *ConsulBackend) CreateSession(name, behavior string, done chan struct{}) (string, error) {
+	session := cb.client.Session()
+	id, _, err := session.Create(&consulapi.SessionEntry{
+		Name:     name,
+		Behavior: behavior,
+		TTL:      SessionTTL,
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	go session.RenewPeriodic(SessionTTL, id, nil, done)
+	return id, nil
+}
+
+// checkSession returns ErrNoSession when the KV must be bound to a session
+// that isn't created yet.
+func (cb *ConsulBackend) checkSession() error {
+	cb.session.Lock()
+	defer cb.session.Unlock()
+
+	if cb.session.required && cb.session.id == "" {
+		return ErrNoSession
+	}
+	return nil
+}
+
+// BindSession creates a session and binds the KV of the backend to it until
+// done is closed. When the session cannot be created, the error is returned
+// and the KV are refused until RetrySession creates it.
+func (cb *ConsulBackend) BindSession(name, behavior string, done chan struct{}) error {
+	cb.session.Lock()
+	cb.session.required = true
+	cb.session.binding = &sessionBinding{name: name, behavior: behavior, done: done}
+	cb.session.Unlock()
+
+	return cb.RetrySession()
+}
+
+// RetrySession creates the session of BindSession when it isn't created
+// yet. It does nothing for a backend that has a session or isn't bound by
+// BindSession.
+func (cb *ConsulBackend) RetrySession() error {
+	cb.session.Lock()
+	defer cb.session.Unlock()
+
+	b := cb.session.binding
+	if b == nil || cb.session.id != "" {
+		return nil
+	}
+
+	select {
+	case <-b.done:
+		return nil
+	default:
+	}
+
+	id, err := cb.CreateSession(b.name, b.behavior, b.done)
+	if err != nil {
+		cb.setLastError("Cannot create session in Consul:", err)
+		return err
+	}
+	cb.session.id = id
+	return nil
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// streamDecoder decodes, for a StreamWatcher, the watch stream of the
+// objects the vendored Kubernetes client doesn't know.
+type streamDecoder struct {
+	stream    io.ReadCloser
+	decoder   *json.Decoder
+	kind      string
+	newObject func() runtime.Object
+}
+
+func newStreamDecoder(stream io.ReadCloser, kind string, newObject func() runtime.Object) *streamDecoder {
+	return &streamDecoder{
+		stream:    stream,
+		decoder:   json.NewDecoder(stream),
+		kind:      kind,
+		newObject: newObject,
+	}
+}
+
+func (d *streamDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	var event struct {
+		Type   watch.EventType `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := d.decoder.Decode(&event); err != nil {
+		return "", nil, err
+	}
+
+	if event.Type == watch.Error {
+		return "", nil, fmt.Errorf("%s watch error: %s", d.kind, event.Object)
+	}
+
+	obj := d.newObject()
+	if err := json.Unmarshal(event.Object, obj); err != nil {
+		return "", nil, err
+	}
+	return event.Type, obj, nil
+}
+
+func (d *streamDecoder) Close() {
+	d.stream.Close()
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Maximum number of operations Consul accepts in a transaction
+const txnMaxOps = 64
+
+const (
+	KVSet       = "set"
+	KVDelete    = "delete"
+	KVCAS       = "cas"
+	KVDeleteCAS = "delete-cas"
+
+	// Verbs the session-bound operations are made of
+	kvLock           = "lock"
+	kvCheckIndex     = "check-index"
+	kvCheckNotExists = "check-not-exists"
+)
+
+// ErrKVConflict is returned when a check-and-set operation fails because the
+// key was modified since it was read.
+var ErrKVConflict = errors.New("KV modified since it was read")
+
+// KVOp is a KV operation of a transaction. The vendored consulapi predates
+// the transaction API, so it is sent through the raw API. Index is the
+// ModifyIndex expected by check-and-set operations, 0 meaning the key must
+// not exist. The values of the set and check-and-set operations with a
+// Session are written with the session acquiring their key.
+type KVOp struct {
+	Verb    string
+	Key     string
+	Value   []byte `json:",omitempty"`
+	Index   uint64 `json:",omitempty"`
+	Session string `json:",omitempty"`
+}
+
+// txnOps returns the transaction operations of an operation. A
+// check-and-set acquiring its key is a check of the index followed by a
+// lock, Consul having no verb doing both.
+func (op KVOp) txnOps() []KVOp {
+	if op.Session == "" || (op.Verb != KVSet && op.Verb != KVCAS) {
+		op.Session = ""
+		return []KVOp{op}
+	}
+
+	lock := KVOp{Verb: kvLock, Key: op.Key, Value: op.Value, Session: op.Session}
+	switch {
+	case op.Verb == KVSet:
+		return []KVOp{lock}
+	case op.Index == 0:
+		return []KVOp{{Verb: kvCheckNotExists, Key: op.Key}, lock}
+	default:
+		return []KVOp{{Verb: kvCheckIndex, Key: op.Key, Index: op.Index}, lock}
+	}
+}
+
+// nextBatch splits the operations fitting in a transaction from the others.
+func nextBatch(ops []KVOp) (batch, rest []KVOp) {
+	size := 0
+	for i, op := range ops {
+		size += len(op.txnOps())
+		if size > txnMaxOps {
+			return ops[:i], ops[i:]
+		}
+	}
+	return ops, nil
+}
+
+type txnOp struct {
+	KV *KVOp
+}
+
+func isTxnUnsupported(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "Unexpected response code: 404") ||
+		strings.Contains(msg, "Unexpected response code: 405")
+}
+
+func isTxnConflict(err error) bool {
+	return strings.Contains(err.Error(), "Unexpected response code: 409")
+}
+
+// ApplyKV applies KV operations in transactions of at most txnMaxOps
+// operations, so that watchers never see a half-applied batch. The
+// operations are applied one by one when Consul doesn't support
+// transactions. ErrKVConflict is returned when a check-and-set fails, the
+// batches already applied are kept, and ErrNoSession when the KV must be
+// bound to a session that isn't created yet.
+func (cb *ConsulBackend) ApplyKV(ops []KVOp) error {
+	if err := cb.checkSession(); err != nil {
+		return err
+	}
+
+	for len(ops) > 0 {
+		var batch []KVOp
+		batch, ops = nextBatch(ops)
+
+		if atomic.LoadInt32(&cb.txnUnsupported) == 0 {
+			err := cb.applyTxn(batch)
+			if err == nil {
+				continue
+			} else if isTxnConflict(err) {
+				return ErrKVConflict
+			} else if !isTxnUnsupported(err) {
+				cb.fail("Cannot apply transaction in Consul:", err)
+				return err
+			}
+
+			if atomic.CompareAndSwapInt32(&cb.txnUnsupported, 0, 1) {
+				glog.Warning("Consul doesn't support transactions, KV are updated one by one")
+			}
+		}
+
+		for _, op := range batch {
+			if err := cb.applyKVOp(op); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (cb *ConsulBackend) applyTxn(ops []KVOp) error {
+	txn := make([]txnOp, 0, len(ops))
+	for _, op := range ops {
+		for _, o := range op.txnOps() {
+			o := o
+			txn = append(txn, txnOp{KV: &o})
+		}
+	}
+
+	_, err := cb.client.Raw().Write("/v1/txn", txn, nil, nil)
+	return err
+}
+
+func (cb *ConsulBackend) applyKVOp(op KVOp) error {
+	kv := cb.client.KV()
+	p := &consulapi.KVPair{Key: op.Key, Value: op.Value, ModifyIndex: op.Index, Session: op.Session}
+
+	var (
+		ok  = true
+		err error
+	)
+
+	switch {
+	case op.Session != "" && op.Verb == KVSet:
+		ok, _, err = kv.Acquire(p, nil)
+	case op.Session != "" && op.Verb == KVCAS:
+		// Not atomic without transactions: the value is checked and set,
+		// then written again acquiring the key
+		if ok, _, err = kv.CAS(p, nil); ok && err == nil {
+			ok, _, err = kv.Acquire(p, nil)
+		}
+	case op.Verb == KVSet:
+		cb.PutKV(op.Key, string(op.Value))
+	case op.Verb == KVDelete:
+		cb.DeleteKV(op.Key)
+	case op.Verb == KVCAS:
+		ok, _, err = kv.CAS(p, nil)
+	case op.Verb == KVDeleteCAS:
+		ok, _, err = kv.DeleteCAS(p, nil)
+	}
+
+	if err != nil {
+		cb.fail("Cannot update value in Consul:", err)
+		return err
+	} else if !ok {
+		return ErrKVConflict
+	}
+	return nil
+}
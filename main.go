@@ -2,69 +2,233 @@ package main
 
 import (
 	"flag"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/coreos/pkg/flagutil"
 	"github.com/golang/glog"
 	consulapi "github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/lightcode/kube2consul/core"
 	"github.com/lightcode/kube2consul/plugins"
 
 	// Plugins need to be imported for their init() to get executed and them to register
+	_ "github.com/lightcode/kube2consul/plugins/intentions"
 	_ "github.com/lightcode/kube2consul/plugins/services"
 )
 
 const ServiceLeaderKey = "lock/services_leader"
 
+// Version of kube2consul, set at build time with
+// -ldflags "-X main.Version=<version>"
+var Version = "dev"
+
+// The services KV are not bound to the leader session by default
+const KV_SESSION_NONE = "none"
+
 var (
 	consulClient *api.ConsulBackend
 	consulLock   *consulapi.Lock
 	opts         CmdLineOpts
-	sigch        chan os.Signal
+
+	// SIGHUP triggers a resync, the other signals stop kube2consul
+	hupch chan os.Signal
+	sigch chan os.Signal
+
+	// Session holding the leader lock with -kv-session, destroyed when
+	// leaderDone is closed
+	leaderSession string
+	leaderDone    chan struct{}
 )
 
 type CmdLineOpts struct {
-	kubeAPI   string
-	consulAPI string
+	kubeAPI        string
+	consulAPI      string
+	endpointSource string
+	httpAddress    string
+	consulTargets  targetsFlag
+	targetInclude  filtersFlag
+	targetExclude  filtersFlag
+	kvSession      string
+}
+
+// targetsFlag collects the Consul targets, separated by semicolons or given
+// by several flags.
+type targetsFlag []string
+
+func (f *targetsFlag) String() string {
+	return strings.Join(*f, ";")
+}
+
+func (f *targetsFlag) Set(value string) error {
+	for _, spec := range strings.Split(value, ";") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			*f = append(*f, spec)
+		}
+	}
+	return nil
+}
+
+// filtersFlag collects the values of a flag given several times.
+type filtersFlag []string
+
+func (f *filtersFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *filtersFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
 
 func init() {
 	flag.StringVar(&opts.kubeAPI, "kubernetes-api", "http://127.0.0.1:8080", "Kubernetes API URL")
-	flag.StringVar(&opts.consulAPI, "consul-api", "127.0.0.1:8500", "Consul API URL")
+	flag.StringVar(&opts.consulAPI, "consul-api", "127.0.0.1:8500", "Comma separated Consul agents, a host name standing for all its addresses. The next agent is used when the current one is down")
+	flag.StringVar(&opts.endpointSource, "endpoint-source", api.EndpointsSource, "Kubernetes objects endpoints are read from (endpoints or endpointslices)")
+	flag.StringVar(&opts.httpAddress, "http-address", "", "Listen address of the HTTP server exposing metrics and the admin API, disabled if empty")
+	flag.Var(&opts.consulTargets, "consul-targets", "Semicolon separated Consul targets the services are exported to, each of them being name=<name>,address=<address>[|<address>...][,token=<token>][,datacenter=<dc>]. The services are exported to -consul-api when empty")
+	flag.Var(&opts.targetInclude, "consul-target-include", "Regexp of the services exported to a Consul target, as <target name>=<regexp>, repeated for each target")
+	flag.Var(&opts.targetExclude, "consul-target-exclude", "Regexp of the services not exported to a Consul target, as <target name>=<regexp>, repeated for each target")
+	flag.StringVar(&opts.kvSession, "kv-session", KV_SESSION_NONE, "Bind the services KV to the leader session: none, release (the keys are released when the session is invalidated) or delete (the keys are deleted)")
 }
 
-func run() {
-	kubeWatcher := api.NewKubeWatcher(opts.kubeAPI)
-	db := api.NewDatabase(opts.kubeAPI)
-	pm := plugins.NewPluginManager(db, consulClient, kubeWatcher)
+func checkKVSession() {
+	switch opts.kvSession {
+	case KV_SESSION_NONE, consulapi.SessionBehaviorRelease, consulapi.SessionBehaviorDelete:
+	default:
+		glog.Fatalf("Unknown KV session behavior '%s'", opts.kvSession)
+	}
+}
+
+// consulTargets returns the Consul targets. The errors of a target don't
+// stop kube2consul when there are several.
+func consulTargets() []*plugins.Target {
+	if len(opts.consulTargets) == 0 {
+		consulClient.UseSession(leaderSession)
+		return []*plugins.Target{{Name: "default", Consul: consulClient}}
+	}
+
+	targets := make([]*plugins.Target, 0, len(opts.consulTargets))
+	for _, spec := range opts.consulTargets {
+		t, err := plugins.ParseTarget(spec)
+		if err != nil {
+			glog.Fatalln(err)
+		}
+		if len(opts.consulTargets) > 1 {
+			t.Consul.ContinueOnError(t.Name)
+		}
+		if leaderSession != "" {
+			// The leader session only exists in the datacenter of
+			// -consul-api, each target has its own session destroyed
+			// along with it
+			if err := t.Consul.BindSession("kube2consul "+t.Name, opts.kvSession, leaderDone); err != nil {
+				glog.Errorf("Cannot create session of Consul target %s, retried on its next sync: %s", t.Name, err)
+			}
+		}
+		targets = append(targets, t)
+	}
+
+	if err := plugins.SetFilters(targets, "include", opts.targetInclude); err != nil {
+		glog.Fatalln(err)
+	}
+	if err := plugins.SetFilters(targets, "exclude", opts.targetExclude); err != nil {
+		glog.Fatalln(err)
+	}
+	return targets
+}
+
+// run exports the services until done is closed, when the lock is lost.
+func run(done chan struct{}) {
+	endpointSource := api.NewEndpointSource(opts.kubeAPI, opts.endpointSource)
+	kubeWatcher := api.NewKubeWatcher(opts.kubeAPI, endpointSource, done)
+	db := api.NewDatabase(opts.kubeAPI, endpointSource)
+	metadata := api.NewMetadataStore(opts.kubeAPI, done)
+	networkPolicies := api.NewNetworkPolicySource(opts.kubeAPI)
+	targets := consulTargets()
+	pm := plugins.NewPluginManager(db, targets, kubeWatcher, metadata, networkPolicies, done)
 
 	pm.Initialize()
 	db.UpdateDatabase()
 	pm.Sync()
 
 	ch := make(chan struct{})
-	go db.StartWatching(ch)
+	go db.StartWatching(ch, done)
 
 	go kubeWatcher.Start()
 
 	for {
 		select {
-		case s := <-sigch:
-			if s == syscall.SIGHUP {
-				glog.Info("User trigger an update")
-				pm.Sync()
-			}
+		case <-hupch:
+			glog.Info("User trigger an update")
+			pm.Sync()
 		case <-ch:
 			pm.Sync()
+		case <-done:
+			// The targets of -consul-targets are created for each run
+			for _, t := range targets {
+				if t.Consul != consulClient {
+					t.Consul.Close()
+				}
+			}
+			return
 		}
 	}
 }
 
+func serveHTTP() {
+	http.Handle("/metrics", prometheus.Handler())
+
+	glog.Infof("Listen on %s", opts.httpAddress)
+	if err := http.ListenAndServe(opts.httpAddress, nil); err != nil {
+		glog.Fatal(err)
+	}
+}
+
+// newLeaderLock creates the leader lock. With -kv-session, the lock is held
+// by a session created here, whose behavior applies to the services KV bound
+// to it.
+func newLeaderLock() {
+	lockOpts := &consulapi.LockOptions{
+		Key:         ServiceLeaderKey,
+		SessionName: "kube2consul lock",
+	}
+
+	if opts.kvSession != KV_SESSION_NONE {
+		leaderDone = make(chan struct{})
+
+		var err error
+		leaderSession, err = consulClient.CreateSession(lockOpts.SessionName, opts.kvSession, leaderDone)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		lockOpts.Session = leaderSession
+	}
+
+	var err error
+	consulLock, err = consulClient.Client().LockOpts(lockOpts)
+	if err != nil {
+		glog.Fatal(err)
+	}
+}
+
+// endLeaderSession destroys the leader session, the KV bound to it being
+// released or deleted.
+func endLeaderSession() {
+	if leaderDone != nil {
+		close(leaderDone)
+		leaderDone = nil
+		leaderSession = ""
+		consulClient.UseSession("")
+	}
+}
+
 func attemptGetLock() <-chan struct{} {
 	glog.Info("Attempting to get lock...")
+	newLeaderLock()
 	lockch, err := consulLock.Lock(nil)
 	if err != nil {
 		glog.Fatal(err)
@@ -77,6 +241,7 @@ func attemptGetLock() <-chan struct{} {
 
 func releaseLock() {
 	consulLock.Unlock()
+	endLeaderSession()
 	glog.Info("Lock has been released")
 }
 
@@ -85,24 +250,23 @@ func main() {
 
 	flagutil.SetFlagsFromEnv(flag.CommandLine, "K2C")
 
-	consulClient = api.NewConsulClient(opts.consulAPI)
+	plugins.SetVersion(Version)
 
-	consul := consulClient.Client()
-
-	var err error
-	consulLock, err = consul.LockOpts(&consulapi.LockOptions{
-		Key:         ServiceLeaderKey,
-		SessionName: "kube2consul lock",
-	})
-	if err != nil {
-		glog.Fatal(err)
+	if opts.httpAddress != "" {
+		go serveHTTP()
 	}
 
+	checkKVSession()
+
+	consulClient = api.NewConsulClient(opts.consulAPI)
+
 	defer releaseLock()
 
+	hupch = make(chan os.Signal, 1)
+	signal.Notify(hupch, syscall.SIGHUP)
+
 	sigch = make(chan os.Signal, 1)
 	signal.Notify(sigch,
-		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
@@ -110,14 +274,17 @@ func main() {
 LOCK:
 	lockch := attemptGetLock()
 
-	go run()
+	done := make(chan struct{})
+	go run(done)
 
 	select {
 	case <-lockch:
+		glog.Info("Lock has been lost, stop exporting the services")
+		close(done)
+		endLeaderSession()
 		goto LOCK
-	case s := <-sigch:
-		if s == syscall.SIGINT || s == syscall.SIGTERM || s == syscall.SIGQUIT {
-			return
-		}
+	case <-sigch:
+		close(done)
+		return
 	}
 }
@@ -1,17 +1,37 @@
 package plugins
 
 import (
+	"sort"
+	"time"
+
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/lightcode/kube2consul/core"
 )
 
-var plugins map[string]PluginEntry = make(map[string]PluginEntry)
+const targetCheckInterval = time.Second * 10
+
+var (
+	plugins map[string]PluginEntry = make(map[string]PluginEntry)
+
+	targetUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "kube2consul",
+			Name:      "consul_target_up",
+			Help:      "Whether the agent of a Consul target answers.",
+		},
+		[]string{"target"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(targetUp)
+}
 
 type PluginEntry struct {
-	name          string
-	isInitialized bool
-	plugin        Plugin
+	name    string
+	factory func() Plugin
 }
 
 type Plugin interface {
@@ -19,36 +39,224 @@ type Plugin interface {
 	Sync()
 }
 
-func Register(name string, plugin Plugin) {
+// AgentCleaner is implemented by the plugins writing registrations local to
+// a Consul agent. CleanAgent removes them from an agent the target failed
+// over from, once it answers again.
+type AgentCleaner interface {
+	CleanAgent(agent *api.ConsulBackend)
+}
+
+// Register adds a plugin, factory returning the instance of each target.
+func Register(name string, factory func() Plugin) {
 	glog.Infof("Register plugin \"%s\"", name)
 	plugins[name] = PluginEntry{
-		name:          name,
-		plugin:        plugin,
-		isInitialized: false,
+		name:    name,
+		factory: factory,
 	}
 }
 
+// PluginManager drives one instance of each plugin per Consul target. The
+// instances are given their own PluginManager whose Consul and Target are
+// the ones of their target. Everything stops once done is closed, when the
+// leadership is lost.
 type PluginManager struct {
 	Db          *api.Database
 	Consul      *api.ConsulBackend
 	KubeWatcher *api.KubeWatcher
+	Metadata    *api.MetadataStore
+
+	NetworkPolicies *api.NetworkPolicySource
+
+	Target *Target
+
+	runners []*targetRunner
+	done    <-chan struct{}
+}
+
+// targetRunner syncs the plugins of a target in its own goroutine, so that
+// a target that is down doesn't stall the others.
+type targetRunner struct {
+	target  *Target
+	plugins []Plugin
+	names   []string
+	syncs   chan struct{}
+	status  *targetStatus
+	done    <-chan struct{}
+
+	// Agents the target failed over from that answer again
+	returns chan *api.ConsulBackend
 }
 
-func NewPluginManager(db *api.Database, cb *api.ConsulBackend, kw *api.KubeWatcher) *PluginManager {
-	return &PluginManager{Db: db, Consul: cb, KubeWatcher: kw}
+func NewPluginManager(db *api.Database, targets []*Target, kw *api.KubeWatcher, ms *api.MetadataStore, nps *api.NetworkPolicySource, done <-chan struct{}) *PluginManager {
+	pm := &PluginManager{Db: db, KubeWatcher: kw, Metadata: ms, NetworkPolicies: nps, done: done}
+
+	for _, t := range targets {
+		pm.runners = append(pm.runners, &targetRunner{
+			target:  t,
+			syncs:   make(chan struct{}, 1),
+			status:  newTargetStatus(t),
+			done:    done,
+			returns: make(chan *api.ConsulBackend, 16),
+		})
+	}
+	if len(targets) > 0 {
+		pm.Consul = targets[0].Consul
+		pm.Target = targets[0]
+	}
+
+	return pm
+}
+
+// forTarget returns the PluginManager given to the plugins of a target.
+func (pm *PluginManager) forTarget(t *Target) *PluginManager {
+	return &PluginManager{
+		Db:              pm.Db,
+		Consul:          t.Consul,
+		KubeWatcher:     pm.KubeWatcher,
+		Metadata:        pm.Metadata,
+		NetworkPolicies: pm.NetworkPolicies,
+		Target:          t,
+		done:            pm.done,
+	}
 }
 
+// Done returns a channel closed when the plugins must stop, their goroutines
+// exiting and nothing being written to Consul anymore.
+func (pm *PluginManager) Done() <-chan struct{} {
+	return pm.done
+}
+
+// Stopped tells if the plugins must stop.
+func (pm *PluginManager) Stopped() bool {
+	select {
+	case <-pm.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sync requests a resync of every target, without waiting for it.
 func (pm *PluginManager) Sync() {
-	for _, e := range plugins {
-		e.plugin.Sync()
+	for _, r := range pm.runners {
+		r.requestSync()
 	}
 }
 
 func (pm *PluginManager) Initialize() {
-	for _, e := range plugins {
-		if !e.isInitialized {
-			e.plugin.Initialize(pm)
-			e.isInitialized = true
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, r := range pm.runners {
+		tpm := pm.forTarget(r.target)
+		for _, name := range names {
+			p := plugins[name].factory()
+			p.Initialize(tpm)
+			r.plugins = append(r.plugins, p)
+			r.names = append(r.names, name)
+		}
+
+		go r.run()
+		go r.check()
+		go r.heartbeat()
+	}
+}
+
+// followAgents resyncs the target when it fails over to another agent, the
+// registrations being local to an agent, and cleans the agent it left once
+// it answers again. The returned function stops following them, the backend
+// of the target outliving the runner.
+func (r *targetRunner) followAgents() (unfollow func()) {
+	unregisterChange := r.target.Consul.OnAgentChange(func(previous, current string) {
+		glog.Infof("Consul target %s moved from agent %s to %s, resync it", r.target.Name, previous, current)
+		r.requestSync()
+	})
+	unregisterReturn := r.target.Consul.OnAgentReturn(func(agent *api.ConsulBackend) {
+		select {
+		case r.returns <- agent:
+		case <-r.done:
+		}
+	})
+
+	return func() {
+		unregisterChange()
+		unregisterReturn()
+	}
+}
+
+func (r *targetRunner) requestSync() {
+	select {
+	case r.syncs <- struct{}{}:
+	default:
+		// A resync is already pending
+	}
+}
+
+func (r *targetRunner) run() {
+	unfollow := r.followAgents()
+	defer unfollow()
+
+	for {
+		select {
+		case <-r.syncs:
+			r.retrySession()
+			for i, p := range r.plugins {
+				r.syncPlugin(r.names[i], p)
+			}
+			r.writeStatus(true)
+		case agent := <-r.returns:
+			glog.Infof("Clean the registrations of Consul target %s left on agent %s", r.target.Name, agent.Agent())
+			for _, p := range r.plugins {
+				if cleaner, ok := p.(AgentCleaner); ok {
+					cleaner.CleanAgent(agent)
+				}
+			}
+		case <-r.done:
+			glog.Infof("Stop syncing Consul target %s", r.target.Name)
+			return
+		}
+	}
+}
+
+// retrySession creates the KV session of the target when it couldn't be
+// created, the KV of the target being refused until then.
+func (r *targetRunner) retrySession() {
+	if err := r.target.Consul.RetrySession(); err != nil {
+		glog.Errorf("Cannot create session of Consul target %s: %s", r.target.Name, err)
+	}
+}
+
+// check follows the state of the target agent, and resyncs the target when
+// it is back since its events were lost.
+func (r *targetRunner) check() {
+	up := true
+
+	ticker := time.NewTicker(targetCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.done:
+			return
+		}
+
+		err := r.target.Consul.Ping()
+		if err != nil && up {
+			glog.Errorf("Consul target %s is down: %s", r.target.Name, err)
+		} else if err == nil && !up {
+			glog.Infof("Consul target %s is back, resync it", r.target.Name)
+			r.requestSync()
+		}
+
+		up = err == nil
+		if up {
+			targetUp.WithLabelValues(r.target.Name).Set(1)
+		} else {
+			targetUp.WithLabelValues(r.target.Name).Set(0)
 		}
 	}
 }
@@ -0,0 +1,111 @@
+package plugins
+
+import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	guardEmptyList     bool
+	maxRemovalFraction float64
+	allowMassRemoval   bool
+	adminToken         string
+
+	// Number of approvals given by an administrator, see RemovalApproval
+	approvals     uint64
+	approvalsLock sync.Mutex
+
+	blockedRemovals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kube2consul",
+			Name:      "blocked_removals_total",
+			Help:      "Number of resyncs whose removals were blocked by the mass removal guard.",
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	flag.BoolVar(&guardEmptyList, "guard-empty-list", true, "Refuse to remove everything when Kubernetes returns no service while Consul has some")
+	flag.Float64Var(&maxRemovalFraction, "max-removal-fraction", 1, "Maximum fraction of the managed services or KV keys removed by a resync")
+	flag.BoolVar(&allowMassRemoval, "allow-mass-removal", false, "Disable the mass removal guard")
+	flag.StringVar(&adminToken, "admin-token", "", "Token required to approve removals, the approvals are refused when empty")
+
+	prometheus.MustRegister(blockedRemovals)
+}
+
+// AuthorizeAdmin tells if a request carries the administrator token in an
+// "Authorization: Bearer" header. Without a configured token, no request is
+// authorized.
+func AuthorizeAdmin(r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	expected := []byte("Bearer " + adminToken)
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+}
+
+// ApproveRemovals approves the removals of the next resync of every plugin
+// instance.
+func ApproveRemovals() {
+	approvalsLock.Lock()
+	approvals++
+	approvalsLock.Unlock()
+}
+
+// RemovalApproval follows the approvals of a plugin instance, each approval
+// being taken once.
+type RemovalApproval struct {
+	taken uint64
+}
+
+// NewRemovalApproval returns the approval of an instance, the approvals
+// given before it was created don't apply to it.
+func NewRemovalApproval() *RemovalApproval {
+	approvalsLock.Lock()
+	defer approvalsLock.Unlock()
+	return &RemovalApproval{taken: approvals}
+}
+
+// Take returns and clears the approval, it is taken once at the beginning
+// of each resync.
+func (a *RemovalApproval) Take() bool {
+	approvalsLock.Lock()
+	defer approvalsLock.Unlock()
+
+	approved := a.taken != approvals
+	a.taken = approvals
+	return approved
+}
+
+// AllowRemoval tells if a resync may remove `removed` of the `managed`
+// entries of a kind when `wanted` entries are expected.
+func AllowRemoval(kind string, removed, managed, wanted int, approved bool) bool {
+	if removed == 0 || managed == 0 || allowMassRemoval {
+		return true
+	}
+
+	var reason string
+	if guardEmptyList && wanted == 0 {
+		reason = "Kubernetes returned an empty list"
+	} else if fraction := float64(removed) / float64(managed); fraction > maxRemovalFraction {
+		reason = fmt.Sprintf("%.0f%% of them would be removed", fraction*100)
+	} else {
+		return true
+	}
+
+	if approved {
+		glog.Warningf("Remove %d of %d managed %s (%s), approved by an administrator", removed, managed, kind, reason)
+		return true
+	}
+
+	glog.Errorf("Refuse to remove %d of %d managed %s: %s. Use -allow-mass-removal or POST /admin/services/approve-removal to proceed", removed, managed, kind, reason)
+	blockedRemovals.WithLabelValues(kind).Inc()
+	return false
+}
@@ -0,0 +1,389 @@
+package intentions
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/kubernetes/pkg/watch"
+
+	"github.com/lightcode/kube2consul/core"
+	"github.com/lightcode/kube2consul/plugins"
+)
+
+const watchRetryInterval = time.Second * 5
+
+var (
+	// Running instances of every target
+	instances     []*IntentionsPlugin
+	instancesLock sync.Mutex
+
+	enabled  bool
+	interval time.Duration
+
+	inexpressibleRules = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "kube2consul",
+			Name:      "inexpressible_network_policy_rules",
+			Help:      "Number of NetworkPolicy rules that cannot be expressed as intentions.",
+		},
+		[]string{"target"},
+	)
+)
+
+// IntentionsPlugin maintains the service-intentions config entries of the
+// exported services from the NetworkPolicies selecting their pods.
+type IntentionsPlugin struct {
+	pm *plugins.PluginManager
+
+	// Namespace/name -> policy
+	policies map[string]api.NetworkPolicy
+
+	// Rules of the last update that cannot be expressed as intentions
+	report []Inexpressible
+
+	// Requests an update after a policy change
+	trigger chan struct{}
+
+	// Removals of the next update approved by an administrator
+	approval *plugins.RemovalApproval
+
+	// Errors since the last report, reported in the status document
+	errors plugins.ErrorLog
+
+	sync.Mutex
+}
+
+func init() {
+	flag.BoolVar(&enabled, "intentions", false, "Write the service-intentions config entries translated from the NetworkPolicies")
+	flag.DurationVar(&interval, "intentions-interval", time.Second*30, "Interval of the intentions updates following the pod changes")
+
+	prometheus.MustRegister(inexpressibleRules)
+
+	http.HandleFunc("/admin/intentions/report", handleReport)
+	plugins.Register("intentions", newIntentionsPlugin)
+}
+
+func newIntentionsPlugin() plugins.Plugin {
+	ip := &IntentionsPlugin{
+		policies: make(map[string]api.NetworkPolicy),
+		trigger:  make(chan struct{}, 1),
+		approval: plugins.NewRemovalApproval(),
+	}
+
+	return ip
+}
+
+func policyKey(np api.NetworkPolicy) string {
+	return fmt.Sprintf("%s/%s", np.Metadata.Namespace, np.Metadata.Name)
+}
+
+func (ip *IntentionsPlugin) Initialize(pm *plugins.PluginManager) {
+	ip.pm = pm
+
+	if !enabled {
+		return
+	}
+
+	if err := plugins.CheckNamespaceMode(); err != nil {
+		glog.Fatalln(err)
+	}
+
+	instancesLock.Lock()
+	instances = append(instances, ip)
+	instancesLock.Unlock()
+
+	pm.Metadata.Start()
+	ip.listPolicies()
+
+	go ip.watchPolicies()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ip.trigger:
+			case <-pm.Done():
+				ip.stop()
+				return
+			}
+			ip.update()
+		}
+	}()
+}
+
+// stop forgets the instance once its PluginManager is done.
+func (ip *IntentionsPlugin) stop() {
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+
+	for i, instance := range instances {
+		if instance == ip {
+			instances = append(instances[:i], instances[i+1:]...)
+			break
+		}
+	}
+}
+
+func (ip *IntentionsPlugin) Sync() {
+	if enabled {
+		ip.update()
+	}
+}
+
+// Report returns the last error since the previous report.
+func (ip *IntentionsPlugin) Report() plugins.PluginReport {
+	return plugins.PluginReport{Error: ip.errors.Take()}
+}
+
+func (ip *IntentionsPlugin) listPolicies() {
+	policies, err := ip.pm.NetworkPolicies.List()
+	if err != nil {
+		ip.errors.Errorf("Cannot get NetworkPolicy list: %s", err)
+		return
+	}
+
+	ip.Lock()
+	ip.policies = make(map[string]api.NetworkPolicy, len(policies))
+	for _, np := range policies {
+		ip.policies[policyKey(np)] = np
+	}
+	ip.Unlock()
+}
+
+// watchPolicies keeps the policies up to date, and relists them each time
+// the watch ends so that no event is missed, until the plugin stops.
+func (ip *IntentionsPlugin) watchPolicies() {
+	for !ip.pm.Stopped() {
+		w, err := ip.pm.NetworkPolicies.Watch()
+		if err != nil {
+			glog.Errorf("Cannot watch NetworkPolicies: %s", err)
+			time.Sleep(watchRetryInterval)
+			continue
+		}
+
+		ended := make(chan struct{})
+		go func() {
+			select {
+			case <-ip.pm.Done():
+				w.Stop()
+			case <-ended:
+			}
+		}()
+
+		for event := range w.ResultChan() {
+			np, ok := event.Object.(*api.NetworkPolicy)
+			if !ok {
+				continue
+			}
+
+			ip.Lock()
+			if event.Type == watch.Deleted {
+				delete(ip.policies, policyKey(*np))
+			} else {
+				ip.policies[policyKey(*np)] = *np
+			}
+			ip.Unlock()
+
+			ip.requestUpdate()
+		}
+
+		close(ended)
+
+		if !ip.pm.Stopped() {
+			ip.listPolicies()
+			ip.requestUpdate()
+		}
+	}
+}
+
+func (ip *IntentionsPlugin) requestUpdate() {
+	select {
+	case ip.trigger <- struct{}{}:
+	default:
+		// An update is already pending
+	}
+}
+
+// handleReport lists the rules that cannot be expressed as intentions by
+// Consul target: GET /admin/intentions/report
+func handleReport(w http.ResponseWriter, r *http.Request) {
+	report := make(map[string][]Inexpressible)
+
+	instancesLock.Lock()
+	for _, ip := range instances {
+		ip.Lock()
+		if ip.pm != nil {
+			report[ip.pm.Target.Name] = ip.report
+		}
+		ip.Unlock()
+	}
+	instancesLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		glog.Errorf("Cannot encode intentions report: %s", err)
+	}
+}
+
+func (ip *IntentionsPlugin) update() {
+	approved := ip.approval.Take()
+
+	ip.Lock()
+	policies := make([]api.NetworkPolicy, 0, len(ip.policies))
+	for _, np := range ip.policies {
+		policies = append(policies, np)
+	}
+	ip.Unlock()
+
+	// The policies of a namespace are translated in its Consul scope, with
+	// the services registered in it
+	byScope := make(map[api.Scope][]api.NetworkPolicy)
+	for _, scope := range plugins.ManagedScopes(ip.pm.Consul) {
+		byScope[scope] = make([]api.NetworkPolicy, 0)
+	}
+	for _, np := range policies {
+		scope := plugins.ConsulScope(np.Metadata.Namespace)
+		byScope[scope] = append(byScope[scope], np)
+	}
+
+	wanted := make(map[api.Scope]map[string]api.ServiceIntentions, len(byScope))
+	report := make([]Inexpressible, 0)
+	for _, scope := range sortedScopes(byScope) {
+		t := newTranslator(ip.pm.Metadata, scope, ip.pm.Consul.Scoped(scope).ListServices())
+		entries, scopeReport := t.translate(byScope[scope])
+		wanted[scope] = entries
+		report = append(report, scopeReport...)
+	}
+
+	ip.Lock()
+	if !reflect.DeepEqual(report, ip.report) {
+		for _, item := range report {
+			glog.Warningf("NetworkPolicy %s: %s", item.Policy, item.Reason)
+		}
+	}
+	ip.report = report
+	ip.Unlock()
+	inexpressibleRules.WithLabelValues(ip.pm.Target.Name).Set(float64(len(report)))
+
+	ip.apply(wanted, approved)
+}
+
+// sortedSources returns a copy of an entry whose sources are sorted by name.
+func sortedSources(entry api.ServiceIntentions) api.ServiceIntentions {
+	sources := make([]api.SourceIntention, len(entry.Sources))
+	copy(sources, entry.Sources)
+	sort.Sort(byName(sources))
+	entry.Sources = sources
+	return entry
+}
+
+// sameIntentions tells if two entries are equal, Consul returning the
+// sources in precedence order rather than sorted by name.
+func sameIntentions(a, b api.ServiceIntentions) bool {
+	return reflect.DeepEqual(sortedSources(a), sortedSources(b))
+}
+
+type byName []api.SourceIntention
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+func sortedScopes(byScope map[api.Scope][]api.NetworkPolicy) []api.Scope {
+	scopes := make([]api.Scope, 0, len(byScope))
+	for scope := range byScope {
+		scopes = append(scopes, scope)
+	}
+	sort.Sort(byScopeName(scopes))
+	return scopes
+}
+
+type byScopeName []api.Scope
+
+func (s byScopeName) Len() int      { return len(s) }
+func (s byScopeName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byScopeName) Less(i, j int) bool {
+	if s[i].Partition != s[j].Partition {
+		return s[i].Partition < s[j].Partition
+	}
+	return s[i].Namespace < s[j].Namespace
+}
+
+// apply writes the wanted entries of every scope. The empty list guard
+// applies to the entries of every scope together, a scope without any
+// wanted entry not being an empty list.
+func (ip *IntentionsPlugin) apply(wanted map[api.Scope]map[string]api.ServiceIntentions, approved bool) {
+	var total int
+	for _, entries := range wanted {
+		total += len(entries)
+	}
+
+	for scope, entries := range wanted {
+		ip.applyScope(ip.pm.Consul.Scoped(scope), entries, total, approved)
+	}
+}
+
+// applyScope writes the wanted entries of a scope that changed and removes
+// the owned entries that are not wanted anymore, unless the mass removal
+// guard blocks it. The entries of other clusters or tools are never
+// modified.
+func (ip *IntentionsPlugin) applyScope(consul *api.ConsulBackend, wanted map[string]api.ServiceIntentions, total int, approved bool) {
+	current := make([]api.ServiceIntentions, 0)
+	if err := consul.ListConfigEntries(api.ConfigEntryServiceIntentions, &current); err != nil {
+		ip.errors.Errorf("Cannot list service-intentions config entries: %s", err)
+		return
+	}
+
+	byName := make(map[string]api.ServiceIntentions, len(current))
+	for _, entry := range current {
+		byName[entry.Name] = entry
+	}
+
+	for name, entry := range wanted {
+		if existing, ok := byName[name]; ok && sameIntentions(existing, entry) {
+			continue
+		} else if ok && !plugins.IsOwned(existing.Meta) {
+			glog.Warningf("Config entry service-intentions/%s is owned by another cluster or tool, skip it", name)
+			continue
+		}
+
+		if err := consul.SetConfigEntry(entry); err != nil {
+			ip.errors.Errorf("Cannot write config entry service-intentions/%s: %s", name, err)
+		}
+	}
+
+	owned := 0
+	stale := make([]string, 0)
+	for _, entry := range current {
+		if !plugins.IsOwned(entry.Meta) {
+			continue
+		}
+		owned++
+		if _, ok := wanted[entry.Name]; !ok {
+			stale = append(stale, entry.Name)
+		}
+	}
+
+	// An empty service list from the agent would otherwise remove every
+	// intention
+	if !plugins.AllowRemoval("intentions", len(stale), owned, total, approved) {
+		return
+	}
+
+	for _, name := range stale {
+		if err := consul.DeleteConfigEntry(api.ConfigEntryServiceIntentions, name); err != nil {
+			ip.errors.Errorf("Cannot delete config entry service-intentions/%s: %s", name, err)
+		}
+	}
+}
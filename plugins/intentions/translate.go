@@ -0,0 +1,330 @@
+package intentions
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lightcode/kube2consul/core"
+	"github.com/lightcode/kube2consul/plugins"
+)
+
+// Name of the source intention matching every service
+const wildcard = "*"
+
+// Meta of the registrations naming their Kubernetes service, written by the
+// services plugin
+const metaService = "k8s-service"
+
+// Inexpressible is a NetworkPolicy rule that cannot be expressed as
+// intentions, which only match Consul services and apply to every port of
+// a service.
+type Inexpressible struct {
+	Policy string `json:"policy"`
+	Reason string `json:"reason"`
+}
+
+// source is a source intention and the policies it comes from.
+type source struct {
+	action   string
+	policies []string
+}
+
+// translator resolves the selectors of the policies to the Consul services
+// registered by kube2consul in a Consul scope.
+type translator struct {
+	metadata *api.MetadataStore
+	scope    api.Scope
+
+	// Pod IP -> Consul service names
+	services map[string][]string
+
+	// Consul service name -> Kubernetes service name
+	kubeServices map[string]string
+
+	// Destination -> source name -> source
+	intentions map[string]map[string]*source
+	report     []Inexpressible
+}
+
+func newTranslator(metadata *api.MetadataStore, scope api.Scope, registered map[string]*api.AgentService) *translator {
+	t := &translator{
+		metadata:     metadata,
+		scope:        scope,
+		services:     make(map[string][]string),
+		kubeServices: make(map[string]string),
+		intentions:   make(map[string]map[string]*source),
+		report:       make([]Inexpressible, 0),
+	}
+
+	for _, service := range registered {
+		if !plugins.IsOwned(service.Meta) || service.Kind == api.ServiceKindConnectProxy {
+			continue
+		}
+
+		if name, ok := service.Meta[metaService]; ok {
+			t.kubeServices[service.Service] = name
+		}
+
+		ips := []string{service.Address}
+		for _, addr := range service.TaggedAddresses {
+			ips = append(ips, addr.Address)
+		}
+		for _, ip := range ips {
+			if ip != "" && !containsString(t.services[ip], service.Service) {
+				t.services[ip] = append(t.services[ip], service.Service)
+			}
+		}
+	}
+
+	return t
+}
+
+func containsString(slice []string, value string) bool {
+	for _, s := range slice {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *translator) addReport(np api.NetworkPolicy, format string, args ...interface{}) {
+	t.report = append(t.report, Inexpressible{
+		Policy: policyKey(np),
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+// namespaces returns the names of the namespaces matching a selector.
+func (t *translator) namespaces(selector *api.LabelSelector) []string {
+	names := make([]string, 0)
+	for _, ns := range t.metadata.ListNamespaces() {
+		if selector.Matches(ns.Labels) {
+			names = append(names, ns.Name)
+		}
+	}
+	return names
+}
+
+// serviceNames returns the Consul services of the pods of some namespaces
+// matching a selector, nil matching every pod.
+func (t *translator) serviceNames(namespaces []string, selector *api.LabelSelector) []string {
+	names := make([]string, 0)
+
+	for _, ns := range namespaces {
+		for _, pod := range t.metadata.ListPods(ns) {
+			if selector != nil && !selector.Matches(pod.Labels) {
+				continue
+			}
+			for _, name := range t.services[pod.Status.PodIP] {
+				if !containsString(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// peerServices returns the Consul services of the pods of a peer. The pods
+// of the namespaces of other Consul scopes are reported and skipped, the
+// intentions of a scope only naming its services.
+func (t *translator) peerServices(np api.NetworkPolicy, i int, peer api.NetworkPolicyPeer) []string {
+	namespaces := []string{np.Metadata.Namespace}
+	if peer.NamespaceSelector != nil {
+		namespaces = t.namespaces(peer.NamespaceSelector)
+	}
+
+	scoped := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if plugins.ConsulScope(ns) != t.scope {
+			t.addReport(np, "sources of namespace %s of ingress rule %d are skipped, they are in another Consul namespace", ns, i)
+			continue
+		}
+		scoped = append(scoped, ns)
+	}
+
+	return t.serviceNames(scoped, peer.PodSelector)
+}
+
+// allowsAll tells if rules allow every peer on every port.
+func allowsAll(rules []api.NetworkPolicyRule) bool {
+	for _, rule := range rules {
+		if len(rule.From) == 0 && len(rule.To) == 0 && len(rule.Ports) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// portDestinations returns the destinations of the ports of a rule, each
+// port being the per-port Consul service <service>-<port> of a Kubernetes
+// service, and the Kubernetes services whose ports can't all be mapped.
+func (t *translator) portDestinations(destinations []string, ports []api.NetworkPolicyPort) (mapped, unmapped []string) {
+	mapped, unmapped = make([]string, 0), make([]string, 0)
+
+	byService := make(map[string][]string)
+	for _, destination := range destinations {
+		name := t.kubeServices[destination]
+		byService[name] = append(byService[name], destination)
+	}
+
+	for name, names := range byService {
+		portNames := make([]string, 0, len(ports))
+		for _, port := range ports {
+			if port.Port == nil {
+				// Every port of the protocol
+				portNames = append(portNames, names...)
+				continue
+			}
+
+			portName := fmt.Sprintf("%s-%s", name, port.Port.String())
+			if name == "" || port.EndPort != nil || !containsString(names, portName) {
+				portNames = nil
+				break
+			}
+			portNames = append(portNames, portName)
+		}
+
+		if portNames == nil && name == "" {
+			// Registrations without the Meta of their Kubernetes service
+			unmapped = append(unmapped, strings.Join(names, ", "))
+			continue
+		} else if portNames == nil {
+			unmapped = append(unmapped, name)
+			continue
+		}
+		for _, portName := range portNames {
+			if !containsString(mapped, portName) {
+				mapped = append(mapped, portName)
+			}
+		}
+	}
+
+	sort.Strings(mapped)
+	sort.Strings(unmapped)
+	return mapped, unmapped
+}
+
+func (t *translator) allow(np api.NetworkPolicy, destination, name string) {
+	src, ok := t.intentions[destination][name]
+	if !ok {
+		src = &source{action: api.IntentionActionAllow}
+		t.intentions[destination][name] = src
+	}
+	if !containsString(src.policies, policyKey(np)) {
+		src.policies = append(src.policies, policyKey(np))
+	}
+}
+
+// translatePolicy adds the intentions of a policy. Pods selected by a policy
+// only accept the traffic it allows, so every destination denies the other
+// sources. A rule with ports only allows its sources on the per-port
+// services of the ports, and is skipped for the services whose ports can't
+// be mapped. IP blocks are skipped, the destinations keeping their default
+// deny.
+func (t *translator) translatePolicy(np api.NetworkPolicy) {
+	if np.HasPolicyType(api.PolicyTypeEgress) && !allowsAll(np.Spec.Egress) {
+		t.addReport(np, "egress rules are ignored, intentions are only enforced by the destination")
+	}
+
+	if !np.HasPolicyType(api.PolicyTypeIngress) {
+		return
+	}
+
+	destinations := t.serviceNames([]string{np.Metadata.Namespace}, &np.Spec.PodSelector)
+	for _, destination := range destinations {
+		if _, ok := t.intentions[destination]; !ok {
+			t.intentions[destination] = make(map[string]*source)
+		}
+	}
+
+	for i, rule := range np.Spec.Ingress {
+		ruleDestinations := destinations
+		if len(rule.Ports) > 0 {
+			var unmapped []string
+			ruleDestinations, unmapped = t.portDestinations(destinations, rule.Ports)
+			for _, name := range unmapped {
+				t.addReport(np, "ports of ingress rule %d don't all match a Consul service <service>-<port> of service %s, the rule is skipped for it", i, name)
+			}
+		}
+
+		if len(rule.From) == 0 {
+			for _, destination := range ruleDestinations {
+				t.allow(np, destination, wildcard)
+			}
+			continue
+		}
+
+		for _, peer := range rule.From {
+			if peer.IPBlock != nil {
+				t.addReport(np, "ipBlock %s of ingress rule %d is skipped, intentions only match services", peer.IPBlock.CIDR, i)
+				continue
+			}
+
+			for _, name := range t.peerServices(np, i, peer) {
+				for _, destination := range ruleDestinations {
+					t.allow(np, destination, name)
+				}
+			}
+		}
+	}
+}
+
+// translate returns the service-intentions entries by destination of the
+// policies, and the rules that cannot be expressed.
+func (t *translator) translate(policies []api.NetworkPolicy) (map[string]api.ServiceIntentions, []Inexpressible) {
+	sort.Sort(byKey(policies))
+	for _, np := range policies {
+		t.translatePolicy(np)
+	}
+
+	entries := make(map[string]api.ServiceIntentions, len(t.intentions))
+	for destination, sources := range t.intentions {
+		if _, ok := sources[wildcard]; !ok {
+			sources[wildcard] = &source{action: api.IntentionActionDeny}
+		}
+		if len(sources) == 0 {
+			continue
+		}
+
+		names := make([]string, 0, len(sources))
+		for name := range sources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		entry := api.ServiceIntentions{
+			Kind:    api.ConfigEntryServiceIntentions,
+			Name:    destination,
+			Sources: make([]api.SourceIntention, 0, len(names)),
+			Meta:    plugins.OwnerMeta(),
+		}
+		for _, name := range names {
+			src := sources[name]
+
+			description := "Default deny of the pods selected by NetworkPolicies"
+			if len(src.policies) > 0 {
+				description = "NetworkPolicy " + strings.Join(src.policies, ", ")
+			}
+
+			entry.Sources = append(entry.Sources, api.SourceIntention{
+				Name:        name,
+				Action:      src.action,
+				Description: description,
+			})
+		}
+		entries[destination] = entry
+	}
+
+	return entries, t.report
+}
+
+type byKey []api.NetworkPolicy
+
+func (s byKey) Len() int           { return len(s) }
+func (s byKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byKey) Less(i, j int) bool { return policyKey(s[i]) < policyKey(s[j]) }
@@ -0,0 +1,152 @@
+package plugins
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"github.com/lightcode/kube2consul/core"
+)
+
+// Mappings of the Kubernetes namespaces to Consul Enterprise namespaces
+const (
+	NAMESPACE_NONE          = "none"
+	NAMESPACE_MIRROR        = "mirror"
+	NAMESPACE_PREFIX_MIRROR = "prefix-mirror"
+	NAMESPACE_FIXED         = "fixed"
+	NAMESPACE_MAP           = "map"
+)
+
+var (
+	namespaceMode   string
+	namespaceFixed  string
+	namespacePrefix string
+	namespaceList   string
+	consulPartition string
+
+	namespaceMap map[string]string
+
+	// The mapping is checked by the plugins of every target, and parsed once
+	namespaceOnce sync.Once
+	namespaceErr  error
+)
+
+func init() {
+	flag.StringVar(&namespaceMode, "consul-namespace-mode", NAMESPACE_NONE, "Consul Enterprise namespace of the Kubernetes namespaces: none, mirror, prefix-mirror, fixed or map")
+	flag.StringVar(&namespaceFixed, "consul-namespace", "", "Consul namespace of the fixed mode, and of the namespaces missing from the map")
+	flag.StringVar(&namespacePrefix, "consul-namespace-prefix", "", "Prefix of the Consul namespaces of the prefix-mirror mode")
+	flag.StringVar(&namespaceList, "consul-namespace-map", "", "Comma separated <kubernetes namespace>=<consul namespace> pairs of the map mode")
+	flag.StringVar(&consulPartition, "consul-partition", "", "Consul Enterprise admin partition of the services")
+}
+
+// CheckNamespaceMode checks the namespace mapping flags.
+func CheckNamespaceMode() error {
+	namespaceOnce.Do(func() {
+		namespaceErr = parseNamespaceMode()
+	})
+	return namespaceErr
+}
+
+func parseNamespaceMode() error {
+	namespaceMap = make(map[string]string)
+
+	switch namespaceMode {
+	case NAMESPACE_NONE, NAMESPACE_MIRROR:
+	case NAMESPACE_PREFIX_MIRROR:
+		if namespacePrefix == "" {
+			return fmt.Errorf("Consul namespace prefix can't be empty in prefix-mirror mode")
+		}
+	case NAMESPACE_FIXED:
+		if namespaceFixed == "" {
+			return fmt.Errorf("Consul namespace can't be empty in fixed mode")
+		}
+	case NAMESPACE_MAP:
+		for _, item := range strings.Split(namespaceList, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			s := strings.SplitN(item, "=", 2)
+			if len(s) != 2 || s[0] == "" || s[1] == "" {
+				return fmt.Errorf("Invalid Consul namespace mapping '%s'", item)
+			}
+			namespaceMap[s[0]] = s[1]
+		}
+	default:
+		return fmt.Errorf("Unknown Consul namespace mode '%s'", namespaceMode)
+	}
+
+	return nil
+}
+
+// ConsulScope returns the Consul scope of a Kubernetes namespace.
+func ConsulScope(namespace string) api.Scope {
+	scope := api.Scope{Partition: consulPartition}
+
+	switch namespaceMode {
+	case NAMESPACE_MIRROR:
+		scope.Namespace = namespace
+	case NAMESPACE_PREFIX_MIRROR:
+		scope.Namespace = namespacePrefix + namespace
+	case NAMESPACE_FIXED:
+		scope.Namespace = namespaceFixed
+	case NAMESPACE_MAP:
+		if ns, ok := namespaceMap[namespace]; ok {
+			scope.Namespace = ns
+		} else {
+			scope.Namespace = namespaceFixed
+		}
+	}
+
+	return scope
+}
+
+// RegistrationScope returns the scope of a registration listed in every
+// managed namespace.
+func RegistrationScope(service *api.AgentService) api.Scope {
+	if namespaceMode == NAMESPACE_NONE {
+		return api.Scope{Partition: consulPartition}
+	}
+	return api.Scope{Namespace: service.Namespace, Partition: consulPartition}
+}
+
+// ListAgentServices lists the services of an agent in every managed
+// namespace.
+func ListAgentServices(consul *api.ConsulBackend) map[string]*api.AgentService {
+	scope := api.Scope{Partition: consulPartition}
+	if namespaceMode != NAMESPACE_NONE {
+		scope.Namespace = api.WildcardNamespace
+	}
+	return consul.Scoped(scope).ListServices()
+}
+
+// ManagedScopes returns the scopes kube2consul may have written in, besides
+// the ones of the current services.
+func ManagedScopes(consul *api.ConsulBackend) []api.Scope {
+	scopes := make([]api.Scope, 0)
+
+	switch namespaceMode {
+	case NAMESPACE_NONE, NAMESPACE_FIXED:
+		scopes = append(scopes, ConsulScope(""))
+	case NAMESPACE_MAP:
+		scopes = append(scopes, api.Scope{Namespace: namespaceFixed, Partition: consulPartition})
+		for _, ns := range namespaceMap {
+			scopes = append(scopes, api.Scope{Namespace: ns, Partition: consulPartition})
+		}
+	case NAMESPACE_MIRROR, NAMESPACE_PREFIX_MIRROR:
+		namespaces, err := consul.Scoped(api.Scope{Partition: consulPartition}).ListNamespaces()
+		if err != nil {
+			glog.Errorf("Cannot list Consul namespaces: %s", err)
+			break
+		}
+		for _, ns := range namespaces {
+			if strings.HasPrefix(ns, namespacePrefix) {
+				scopes = append(scopes, api.Scope{Namespace: ns, Partition: consulPartition})
+			}
+		}
+	}
+
+	return scopes
+}
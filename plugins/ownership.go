@@ -0,0 +1,49 @@
+package plugins
+
+import (
+	"flag"
+	"os"
+	"strings"
+)
+
+// Consul objects written by kube2consul carry the cluster and the instance
+// that wrote them in their Meta. Objects of other clusters are never
+// modified.
+const (
+	META_OWNER   = "kube2consul-owner"
+	META_CLUSTER = "kube2consul-cluster"
+)
+
+var (
+	ClusterName   string
+	OwnerInstance string
+
+	// KV prefix of the state kube2consul keeps about the objects it owns
+	StatePrefix string
+)
+
+func init() {
+	hostname, _ := os.Hostname()
+
+	flag.StringVar(&ClusterName, "cluster-name", "kubernetes", "Name of the Kubernetes cluster, registrations of other clusters are never modified")
+	flag.StringVar(&OwnerInstance, "owner-instance", hostname, "Name of this instance, written in the registrations")
+	flag.StringVar(&StatePrefix, "state-prefix", "kube2consul", "KV prefix of the state kept by kube2consul")
+}
+
+// StateKey returns the KV key of a state of this cluster.
+func StateKey(parts ...string) string {
+	return strings.Join(append([]string{strings.Trim(StatePrefix, "/"), ClusterName}, parts...), "/")
+}
+
+// OwnerMeta returns the Meta of the objects written by this instance.
+func OwnerMeta() map[string]string {
+	return map[string]string{
+		META_OWNER:   OwnerInstance,
+		META_CLUSTER: ClusterName,
+	}
+}
+
+// IsOwned tells if an object was written by this cluster from its Meta.
+func IsOwned(meta map[string]string) bool {
+	return meta[META_CLUSTER] == ClusterName
+}
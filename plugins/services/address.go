@@ -0,0 +1,144 @@
+package service
+
+import (
+	"flag"
+	"fmt"
+	"net"
+
+	"github.com/lightcode/kube2consul/core"
+)
+
+// Address family policies
+const (
+	IPV4_ONLY   = "ipv4"
+	IPV6_ONLY   = "ipv6"
+	DUAL_STACK  = "dual"
+	PREFER_IPV4 = "prefer-ipv4"
+	PREFER_IPV6 = "prefer-ipv6"
+)
+
+var addressFamily string
+
+// instance is a single address registered in Consul for every port of a
+// service. AlternateAddress is the address of the other family owned by the
+// same pod, if any.
+type instance struct {
+	Address          string
+	AlternateAddress string
+	Endpoint         api.EndpointAddress
+}
+
+func init() {
+	flag.StringVar(&addressFamily, "address-family", DUAL_STACK, "Address families registered in Consul (ipv4, ipv6, dual, prefer-ipv4 or prefer-ipv6)")
+}
+
+func checkAddressFamily() error {
+	switch addressFamily {
+	case IPV4_ONLY, IPV6_ONLY, DUAL_STACK, PREFER_IPV4, PREFER_IPV6:
+		return nil
+	default:
+		return fmt.Errorf("Unknown address family policy '%s'", addressFamily)
+	}
+}
+
+func isIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+// canonicalIP returns the canonical text form of an IP so that the same
+// address always gives the same service ID.
+func canonicalIP(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// addressPair holds the addresses of both families owned by the same pod.
+type addressPair struct {
+	ipv4, ipv6 api.EndpointAddress
+}
+
+func (p addressPair) instances() []instance {
+	v4 := instance{Address: p.ipv4.IP, AlternateAddress: p.ipv6.IP, Endpoint: p.ipv4}
+	v6 := instance{Address: p.ipv6.IP, AlternateAddress: p.ipv4.IP, Endpoint: p.ipv6}
+	hasV4, hasV6 := p.ipv4.IP != "", p.ipv6.IP != ""
+
+	switch addressFamily {
+	case IPV4_ONLY:
+		if hasV4 {
+			return []instance{v4}
+		}
+	case IPV6_ONLY:
+		if hasV6 {
+			return []instance{v6}
+		}
+	case PREFER_IPV4:
+		if hasV4 {
+			return []instance{v4}
+		} else if hasV6 {
+			return []instance{v6}
+		}
+	case PREFER_IPV6:
+		if hasV6 {
+			return []instance{v6}
+		} else if hasV4 {
+			return []instance{v4}
+		}
+	default:
+		instances := make([]instance, 0, 2)
+		if hasV4 {
+			instances = append(instances, v4)
+		}
+		if hasV6 {
+			instances = append(instances, v6)
+		}
+		return instances
+	}
+	return nil
+}
+
+// selectInstances pairs the ready addresses of each pod by family and keeps
+// the ones allowed by the address family policy.
+func selectInstances(ep api.ServiceEndpoints) []instance {
+	pairs := make(map[string]*addressPair)
+	order := make([]string, 0)
+
+	for _, subset := range ep.Subsets {
+		for _, addr := range subset.Addresses {
+			if !addr.Ready {
+				continue
+			}
+
+			addr.IP = canonicalIP(addr.IP)
+
+			// Addresses without a target can't be paired
+			key := addr.IP
+			if ref := addr.TargetRef; ref != nil {
+				key = fmt.Sprintf("%s/%s/%s", ref.Kind, ref.Namespace, ref.Name)
+			}
+
+			pair, ok := pairs[key]
+			if !ok {
+				pair = new(addressPair)
+				pairs[key] = pair
+				order = append(order, key)
+			}
+
+			if isIPv6(addr.IP) {
+				if pair.ipv6.IP == "" {
+					pair.ipv6 = addr
+				}
+			} else if pair.ipv4.IP == "" {
+				pair.ipv4 = addr
+			}
+		}
+	}
+
+	instances := make([]instance, 0, len(order))
+	for _, key := range order {
+		instances = append(instances, pairs[key].instances()...)
+	}
+	return instances
+}
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lightcode/kube2consul/core"
+)
+
+const (
+	ANNOTATION_CONNECT              = "kube2consul/connect"
+	ANNOTATION_CONNECT_SIDECAR_PORT = "kube2consul/connect-sidecar-port"
+	ANNOTATION_CONNECT_UPSTREAMS    = "kube2consul/connect-upstreams"
+	ANNOTATION_CONNECT_PROXY_CONFIG = "kube2consul/connect-proxy-config"
+
+	CONNECT_NATIVE  = "native"
+	CONNECT_SIDECAR = "sidecar"
+
+	// First port of the Consul sidecar range
+	DEFAULT_SIDECAR_PORT = 21000
+
+	SIDECAR_SUFFIX = "-sidecar-proxy"
+)
+
+// connectConfig is the Connect configuration of a service read from its
+// annotations.
+type connectConfig struct {
+	mode string
+
+	// Sidecar ports by service port name or number, the ports that are not
+	// listed get basePort + their index
+	sidecarPorts map[string]int
+	basePort     int
+
+	upstreams   []api.Upstream
+	proxyConfig map[string]interface{}
+}
+
+// parseUpstreams reads upstreams written as <service>:<port>[:<datacenter>].
+func parseUpstreams(value string) ([]api.Upstream, error) {
+	upstreams := make([]api.Upstream, 0)
+
+	for _, item := range splitList(value) {
+		s := strings.Split(item, ":")
+		if len(s) < 2 || len(s) > 3 || s[0] == "" {
+			return nil, fmt.Errorf("Invalid upstream '%s'", item)
+		}
+
+		port, err := strconv.Atoi(s[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port of upstream '%s'", item)
+		}
+
+		upstream := api.Upstream{DestinationName: s[0], LocalBindPort: port}
+		if len(s) == 3 {
+			upstream.Datacenter = s[2]
+		}
+		upstreams = append(upstreams, upstream)
+	}
+
+	return upstreams, nil
+}
+
+// parseSidecarPorts reads the sidecar ports, either a single first port or
+// <port>=<sidecar port> pairs.
+func parseSidecarPorts(value string, cfg *connectConfig) error {
+	if port, err := strconv.Atoi(value); err == nil {
+		cfg.basePort = port
+		return nil
+	}
+
+	for _, item := range splitList(value) {
+		s := strings.SplitN(item, "=", 2)
+		if len(s) != 2 {
+			return fmt.Errorf("Invalid sidecar port '%s'", item)
+		}
+
+		port, err := strconv.Atoi(s[1])
+		if err != nil {
+			return fmt.Errorf("Invalid sidecar port '%s'", item)
+		}
+		cfg.sidecarPorts[s[0]] = port
+	}
+
+	return nil
+}
+
+// parseConnect returns the Connect configuration of a service, or nil when
+// it is not in the mesh.
+func parseConnect(svc Service) (*connectConfig, error) {
+	mode, ok := svc.Annotations[ANNOTATION_CONNECT]
+	if !ok {
+		return nil, nil
+	}
+
+	cfg := &connectConfig{
+		mode:         mode,
+		sidecarPorts: make(map[string]int),
+		basePort:     DEFAULT_SIDECAR_PORT,
+	}
+
+	switch mode {
+	case CONNECT_NATIVE:
+		return cfg, nil
+	case CONNECT_SIDECAR:
+	default:
+		return nil, fmt.Errorf("Unknown Connect mode '%s'", mode)
+	}
+
+	if value, ok := svc.Annotations[ANNOTATION_CONNECT_SIDECAR_PORT]; ok {
+		if err := parseSidecarPorts(value, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if value, ok := svc.Annotations[ANNOTATION_CONNECT_UPSTREAMS]; ok {
+		upstreams, err := parseUpstreams(value)
+		if err != nil {
+			return nil, err
+		}
+		cfg.upstreams = upstreams
+	}
+
+	if value, ok := svc.Annotations[ANNOTATION_CONNECT_PROXY_CONFIG]; ok {
+		if err := json.Unmarshal([]byte(value), &cfg.proxyConfig); err != nil {
+			return nil, fmt.Errorf("Invalid proxy config: %s", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// sidecarPort returns the port of the sidecar of the index-th exported port.
+func (cfg *connectConfig) sidecarPort(port servicePort, index int) int {
+	if p, ok := cfg.sidecarPorts[port.Name]; ok && port.Name != "" {
+		return p
+	} else if p, ok := cfg.sidecarPorts[strconv.Itoa(port.Port)]; ok {
+		return p
+	}
+	return cfg.basePort + index
+}
+
+// sidecarRegistration returns the registration of the sidecar proxy of a
+// service instance, which proxies to the service through the loopback of
+// the pod.
+func (cfg *connectConfig) sidecarRegistration(service *api.ServiceRegistration, inst instance, port int) *api.ServiceRegistration {
+	meta := make(map[string]string, len(service.Meta))
+	for key, value := range service.Meta {
+		if key != META_HASH {
+			meta[key] = value
+		}
+	}
+
+	return &api.ServiceRegistration{
+		Kind:            api.ServiceKindConnectProxy,
+		ID:              service.ID + SIDECAR_SUFFIX,
+		Name:            service.Name + SIDECAR_SUFFIX,
+		Address:         service.Address,
+		Port:            port,
+		Tags:            service.Tags,
+		TaggedAddresses: taggedAddresses(inst, port),
+		Meta:            meta,
+		Namespace:       service.Namespace,
+		Partition:       service.Partition,
+		Proxy: &api.AgentServiceProxy{
+			DestinationServiceName: service.Name,
+			DestinationServiceID:   service.ID,
+			LocalServiceAddress:    "127.0.0.1",
+			LocalServicePort:       service.Port,
+			Config:                 cfg.proxyConfig,
+			Upstreams:              cfg.upstreams,
+		},
+	}
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"bytes"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	"github.com/lightcode/kube2consul/core"
+)
+
+// Version of the service document. Consumers must ignore the fields they
+// don't know and check the schema before relying on a changed field.
+const SERVICE_SCHEMA = 2
+
+// EndpointDetail describes an address of a service, ready or not.
+type EndpointDetail struct {
+	IP          string `json:"ip"`
+	Pod         string `json:"pod,omitempty"`
+	Node        string `json:"node,omitempty"`
+	Zone        string `json:"zone,omitempty"`
+	Ready       bool   `json:"ready"`
+	Serving     bool   `json:"serving"`
+	Terminating bool   `json:"terminating"`
+}
+
+func clusterIPs(svc kapi.Service) []string {
+	ips := make([]string, 0, 1)
+	if ip := svc.Spec.ClusterIP; ip != "" && ip != kapi.ClusterIPNone {
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func loadBalancerIngress(svc kapi.Service) []kapi.LoadBalancerIngress {
+	ingress := make([]kapi.LoadBalancerIngress, 0, len(svc.Status.LoadBalancer.Ingress))
+	return append(ingress, svc.Status.LoadBalancer.Ingress...)
+}
+
+// endpointDetails returns every address of the endpoints. The node and zone
+// are completed from the metadata store when the endpoint source doesn't
+// give them.
+func (sp *ServicePlugin) endpointDetails(ep api.ServiceEndpoints) []EndpointDetail {
+	details := make([]EndpointDetail, 0)
+
+	for _, subset := range ep.Subsets {
+		for _, addr := range subset.Addresses {
+			detail := EndpointDetail{
+				IP:          canonicalIP(addr.IP),
+				Node:        addr.NodeName,
+				Zone:        addr.Zone,
+				Ready:       addr.Ready,
+				Serving:     addr.Serving,
+				Terminating: addr.Terminating,
+			}
+
+			if ref := addr.TargetRef; ref != nil && ref.Kind == "Pod" {
+				detail.Pod = ref.Name
+				if detail.Node == "" {
+					if pod, ok := sp.pm.Metadata.GetPod(ref.Namespace, ref.Name); ok {
+						detail.Node = pod.Spec.NodeName
+					}
+				}
+			}
+
+			if detail.Zone == "" && detail.Node != "" {
+				if node, ok := sp.pm.Metadata.GetNode(detail.Node); ok {
+					detail.Zone, _ = api.NodeTopology(node)
+				}
+			}
+
+			details = append(details, detail)
+		}
+	}
+
+	return details
+}
+
+// encodeService encodes the document of a service, LastSynced being the
+// time of the sync writing it. See keepLastSynced.
+func (sp *ServicePlugin) encodeService(svc Service) []byte {
+	svc.LastSynced = time.Now().UTC()
+	return encodeDocument(svc)
+}
+
+// keepLastSynced returns the desired values, the documents only differing
+// from the current ones by LastSynced being replaced by the current ones.
+// LastSynced is so the time the content of the service last changed, and
+// the unchanged documents aren't written again.
+func keepLastSynced(values map[string][]byte, current map[string]*consulapi.KVPair) map[string][]byte {
+	if kvLayout != KV_LAYOUT_DOCUMENT {
+		return values
+	}
+
+	kept := make(map[string][]byte, len(values))
+	for key, value := range values {
+		kept[key] = value
+
+		kp, ok := current[key]
+		if !ok {
+			continue
+		}
+
+		var desired, previous Service
+		if decodeDocument(value, &desired) != nil || decodeDocument(kp.Value, &previous) != nil {
+			continue
+		}
+
+		desired.LastSynced = previous.LastSynced
+		if bytes.Equal(encodeDocument(desired), kp.Value) {
+			kept[key] = kp.Value
+		}
+	}
+	return kept
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"flag"
+	"time"
+
+	"github.com/golang/glog"
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/watch"
+
+	"github.com/lightcode/kube2consul/plugins"
+)
+
+const (
+	DRAIN_REASON        = "Kubernetes endpoint is terminating"
+	drainExpireInterval = time.Second * 5
+)
+
+var drainPeriod time.Duration
+
+func init() {
+	flag.DurationVar(&drainPeriod, "drain-period", 0, "Time instances of terminating pods stay in maintenance before being deregistered, 0 deregisters them immediately")
+}
+
+func (sp *ServicePlugin) startDraining() {
+	ch := make(chan watch.Event)
+	sp.pm.Metadata.Subscribe(ch)
+
+	go func() {
+		ticker := time.NewTicker(drainExpireInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case event := <-ch:
+				if pod, ok := event.Object.(*kapi.Pod); ok {
+					sp.handlePodEvent(*pod)
+				}
+			case <-ticker.C:
+				sp.expireDrains()
+			case <-sp.pm.Done():
+				return
+			}
+		}
+	}()
+}
+
+// handlePodEvent drains the instances of a pod as soon as it is deleted,
+// before its endpoints are updated. Only the services whose endpoints
+// reference the pod are drained, the IP of a pod on the host network being
+// the one of every such pod of its node.
+func (sp *ServicePlugin) handlePodEvent(pod kapi.Pod) {
+	if pod.DeletionTimestamp == nil || pod.Status.PodIP == "" {
+		return
+	}
+
+	keys := sp.podServices(pod.Namespace, pod.Name)
+	if len(keys) == 0 {
+		return
+	}
+
+	for id, service := range sp.listAllServices() {
+		if !isManaged(service) || canonicalIP(service.Address) != canonicalIP(pod.Status.PodIP) {
+			continue
+		}
+
+		owner, err := serviceOwner(id, service)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			if isServiceOwner(owner, key) {
+				sp.drainService(registrationRef{ID: id, Scope: plugins.RegistrationScope(service)})
+				break
+			}
+		}
+	}
+}
+
+// isTerminating tells if the pod of an instance is being deleted. It is
+// only known when pods are cached.
+func (sp *ServicePlugin) isTerminating(inst instance) bool {
+	if drainPeriod == 0 {
+		return false
+	}
+
+	ref := inst.Endpoint.TargetRef
+	if ref == nil || ref.Kind != "Pod" {
+		return false
+	}
+
+	pod, ok := sp.pm.Metadata.GetPod(ref.Namespace, ref.Name)
+	return ok && pod.DeletionTimestamp != nil
+}
+
+// drainService puts a service in maintenance until the drain period expires,
+// the service is deregistered immediately if there is no drain period.
+func (sp *ServicePlugin) drainService(ref registrationRef) {
+	consul := sp.pm.Consul.Scoped(ref.Scope)
+
+	if drainPeriod == 0 {
+		glog.Infof("Remove service '%s' in Consul", ref.ID)
+		consul.RemoveService(ref.ID)
+		return
+	}
+
+	sp.Lock()
+	_, ok := sp.draining[ref]
+	if !ok {
+		sp.draining[ref] = time.Now()
+	}
+	sp.Unlock()
+
+	if ok {
+		return
+	}
+
+	glog.Infof("Drain service '%s' in Consul for %s", ref.ID, drainPeriod)
+	if err := consul.EnableServiceMaintenance(ref.ID, DRAIN_REASON); err != nil {
+		sp.errors.Errorf("Cannot put service '%s' in maintenance: %s", ref.ID, err)
+	}
+}
+
+// undrainService gets a service out of maintenance when its endpoint is
+// back before the end of the drain period.
+func (sp *ServicePlugin) undrainService(ref registrationRef) {
+	sp.Lock()
+	_, ok := sp.draining[ref]
+	delete(sp.draining, ref)
+	sp.Unlock()
+
+	if !ok {
+		return
+	}
+
+	glog.Infof("Service '%s' is back, stop draining it", ref.ID)
+	if err := sp.pm.Consul.Scoped(ref.Scope).DisableServiceMaintenance(ref.ID); err != nil {
+		sp.errors.Errorf("Cannot remove maintenance of service '%s': %s", ref.ID, err)
+	}
+}
+
+func (sp *ServicePlugin) expireDrains() {
+	expired := make([]registrationRef, 0)
+
+	sp.Lock()
+	for ref, start := range sp.draining {
+		if time.Since(start) >= drainPeriod {
+			expired = append(expired, ref)
+			delete(sp.draining, ref)
+		}
+	}
+	sp.Unlock()
+
+	for _, ref := range expired {
+		glog.Infof("Remove drained service '%s' in Consul", ref.ID)
+		sp.pm.Consul.Scoped(ref.Scope).RemoveService(ref.ID)
+	}
+}
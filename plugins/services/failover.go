@@ -0,0 +1,24 @@
+package service
+
+import (
+	"github.com/golang/glog"
+
+	"github.com/lightcode/kube2consul/core"
+	"github.com/lightcode/kube2consul/plugins"
+)
+
+// CleanAgent removes the managed registrations left on an agent the target
+// failed over from. They were written again on the current agent, and
+// would otherwise be duplicated in the catalog.
+func (sp *ServicePlugin) CleanAgent(agent *api.ConsulBackend) {
+	removed := 0
+	for id, service := range plugins.ListAgentServices(agent) {
+		if !isManaged(service) {
+			continue
+		}
+		agent.Scoped(plugins.RegistrationScope(service)).RemoveService(id)
+		removed++
+	}
+
+	glog.Infof("%d services removed from Consul agent %s", removed, agent.Agent())
+}
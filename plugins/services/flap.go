@@ -0,0 +1,145 @@
+package service
+
+import (
+	"flag"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	debounceWindow time.Duration
+	flapThreshold  int
+	flapWindow     time.Duration
+
+	// Not labelled by service, which would give a series per service of
+	// the cluster; the services are logged instead
+	coalescedEvents = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "kube2consul",
+			Name:      "coalesced_events_total",
+			Help:      "Number of Kubernetes events coalesced in the debounce window of their service.",
+		},
+	)
+
+	flapSuppressions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "kube2consul",
+			Name:      "flap_suppressions_total",
+			Help:      "Number of instance registrations suppressed because the instance is flapping.",
+		},
+	)
+)
+
+// flapState is the registration history of a Consul service ID, service
+// being the namespace/name of its Kubernetes service. Flapping instances are
+// kept out of Consul until they are stable for flapWindow.
+type flapState struct {
+	service     string
+	present     bool
+	transitions []time.Time
+}
+
+func init() {
+	flag.DurationVar(&debounceWindow, "debounce", 0, "Window in which the events of a service are coalesced before updating Consul, 0 disables it")
+	flag.IntVar(&flapThreshold, "flap-threshold", 0, "Number of registration changes of an instance in the flap window after which it is held out of Consul, 0 disables it")
+	flag.DurationVar(&flapWindow, "flap-window", time.Minute*5, "Window in which the registration changes of an instance are counted")
+
+	prometheus.MustRegister(coalescedEvents)
+	prometheus.MustRegister(flapSuppressions)
+}
+
+// scheduleUpdate updates a service, key being its namespace/name, after the
+// debounce window. The other events received in the window are coalesced in
+// this update.
+func (sp *ServicePlugin) scheduleUpdate(key string) {
+	if debounceWindow == 0 {
+		sp.updateService(key)
+		return
+	}
+
+	sp.Lock()
+	defer sp.Unlock()
+
+	if _, ok := sp.pending[key]; ok {
+		glog.Infof("Event of service %s coalesced with the pending update", key)
+		coalescedEvents.Inc()
+		return
+	}
+
+	sp.pending[key] = time.AfterFunc(debounceWindow, func() {
+		sp.Lock()
+		delete(sp.pending, key)
+		sp.Unlock()
+
+		if !sp.pm.Stopped() {
+			sp.updateService(key)
+		}
+	})
+}
+
+// cancelUpdate drops the pending update of a service.
+func (sp *ServicePlugin) cancelUpdate(key string) {
+	sp.Lock()
+	if timer, ok := sp.pending[key]; ok {
+		timer.Stop()
+		delete(sp.pending, key)
+	}
+	sp.Unlock()
+}
+
+// trackFlaps records the instances wanted in Consul for a service and
+// returns the ones that must be held out because they flap.
+func (sp *ServicePlugin) trackFlaps(key string, ids []string) (suppressed map[string]bool) {
+	suppressed = make(map[string]bool)
+
+	if flapThreshold == 0 {
+		return suppressed
+	}
+
+	now := time.Now()
+
+	sp.Lock()
+	defer sp.Unlock()
+
+	for id, state := range sp.flaps {
+		if state.service == key && state.present && !inSlice(id, ids) {
+			state.present = false
+			state.transitions = append(state.transitions, now)
+		}
+	}
+
+	for _, id := range ids {
+		if state, ok := sp.flaps[id]; !ok {
+			sp.flaps[id] = &flapState{service: key, present: true}
+		} else if !state.present {
+			state.present = true
+			state.transitions = append(state.transitions, now)
+		}
+	}
+
+	for id, state := range sp.flaps {
+		if state.service != key {
+			continue
+		}
+
+		recent := make([]time.Time, 0, len(state.transitions))
+		for _, t := range state.transitions {
+			if now.Sub(t) < flapWindow {
+				recent = append(recent, t)
+			}
+		}
+		state.transitions = recent
+
+		if len(recent) >= flapThreshold && state.present {
+			glog.Warningf("Service '%s' of %s is flapping (%d changes in %s), hold it out of Consul", id, key, len(recent), flapWindow)
+			flapSuppressions.Inc()
+			suppressed[id] = true
+		} else if len(recent) == 0 && !state.present {
+			delete(sp.flaps, id)
+		}
+	}
+
+	return suppressed
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+
+	"github.com/lightcode/kube2consul/plugins"
+)
+
+// handleApproval lets an administrator approve the removals of the next
+// resync of every target and plugin: POST /admin/services/approve-removal
+// with the token of -admin-token.
+func handleApproval(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !plugins.AuthorizeAdmin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	plugins.ApproveRemovals()
+
+	glog.Info("Removals of the next resync approved by an administrator")
+	fmt.Fprintln(w, "Removals of the next resync approved")
+}
+
+// takeApproval returns and clears the administrator approval, it is taken
+// once at the beginning of each resync.
+func (sp *ServicePlugin) takeApproval() bool {
+	return sp.approval.Take()
+}
+
+// allowRemoval tells if a resync may remove `removed` of the `managed`
+// entries of a kind when `wanted` entries are expected.
+func (sp *ServicePlugin) allowRemoval(kind string, removed, managed, wanted int, approved bool) bool {
+	return plugins.AllowRemoval(kind, removed, managed, wanted, approved)
+}
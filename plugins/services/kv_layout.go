@@ -0,0 +1,118 @@
+package service
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+)
+
+const (
+	KV_FORMAT_JSON = "json"
+	KV_FORMAT_YAML = "yaml"
+
+	// One document per service: <prefix>/<namespace>/<service>
+	KV_LAYOUT_DOCUMENT = "document"
+	// One key per value: <prefix>/<namespace>/<service>/ports/<name>, ...
+	KV_LAYOUT_FLAT = "flat"
+)
+
+var (
+	kvPrefix string
+	kvFormat string
+	kvLayout string
+)
+
+func init() {
+	flag.StringVar(&kvPrefix, "kv-prefix", SERVICES_ROOT, "KV prefix the services are written under")
+	flag.StringVar(&kvFormat, "kv-format", KV_FORMAT_JSON, "Encoding of the service documents (json or yaml)")
+	flag.StringVar(&kvLayout, "kv-layout", KV_LAYOUT_DOCUMENT, "Layout of the services KV (document or flat)")
+}
+
+func checkKVLayout() error {
+	kvPrefix = strings.Trim(kvPrefix, "/")
+	if kvPrefix == "" {
+		return fmt.Errorf("KV prefix can't be empty")
+	}
+
+	switch kvFormat {
+	case KV_FORMAT_JSON, KV_FORMAT_YAML:
+	default:
+		return fmt.Errorf("Unknown KV format '%s'", kvFormat)
+	}
+
+	switch kvLayout {
+	case KV_LAYOUT_DOCUMENT, KV_LAYOUT_FLAT:
+	default:
+		return fmt.Errorf("Unknown KV layout '%s'", kvLayout)
+	}
+
+	return nil
+}
+
+func encodeDocument(obj interface{}) []byte {
+	var (
+		value []byte
+		err   error
+	)
+
+	if kvFormat == KV_FORMAT_YAML {
+		value, err = yaml.Marshal(obj)
+	} else {
+		value, err = json.Marshal(obj)
+	}
+
+	if err != nil {
+		glog.Errorf("Cannot encode KV value: %s", err)
+	}
+	return value
+}
+
+func decodeDocument(value []byte, obj interface{}) error {
+	if kvFormat == KV_FORMAT_YAML {
+		return yaml.Unmarshal(value, obj)
+	}
+	return json.Unmarshal(value, obj)
+}
+
+// serviceKVDir returns the directory of a service in the flat layout.
+func serviceKVDir(namespace, name string) string {
+	return fmt.Sprintf("%s/%s/%s/", kvPrefix, namespace, name)
+}
+
+// serviceKVKey returns the key of a service in the document layout.
+func serviceKVKey(namespace, name string) string {
+	return fmt.Sprintf("%s/%s/%s", kvPrefix, namespace, name)
+}
+
+// serviceKV returns the keys and values of a service in the configured layout.
+func (sp *ServicePlugin) serviceKV(svc Service) map[string][]byte {
+	if kvLayout == KV_LAYOUT_DOCUMENT {
+		return map[string][]byte{serviceKVKey(svc.Namespace, svc.Name): sp.encodeService(svc)}
+	}
+
+	dir := serviceKVDir(svc.Namespace, svc.Name)
+	values := make(map[string][]byte)
+
+	for _, port := range svc.PortDetails {
+		name := port.Name
+		if name == "" {
+			name = strconv.Itoa(port.Port)
+		}
+		values[dir+"ports/"+name] = []byte(strconv.Itoa(port.Port))
+	}
+
+	for _, ip := range svc.Endpoints {
+		values[dir+"endpoints/"+ip] = []byte(ip)
+	}
+
+	for key, value := range svc.Annotations {
+		values[dir+"annotations/"+key] = []byte(value)
+	}
+
+	return values
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	ANY_LABEL          = "*"
+	DEFAULT_TAG_FORMAT = "{key}={value}"
+)
+
+var (
+	labelTagRules  string
+	labelMetaRules string
+	labelAllow     string
+
+	tagRules      []labelRule
+	metaRules     []labelRule
+	allowedLabels *regexp.Regexp
+)
+
+// labelRule maps a service label, or any allowed label with ANY_LABEL, to a
+// tag format or a Meta key (a Meta key prefix for ANY_LABEL).
+type labelRule struct {
+	Label  string
+	Target string
+}
+
+func init() {
+	flag.StringVar(&labelTagRules, "label-tags", "", "Comma separated label=format rules mirroring service labels into tags, format may use {key} and {value}, * matches every label")
+	flag.StringVar(&labelMetaRules, "label-meta", "", "Comma separated label=key rules mirroring service labels into Meta, *=prefix mirrors every label")
+	flag.StringVar(&labelAllow, "label-allow", "", "Regular expression the mirrored label keys must match")
+}
+
+func parseLabelRules(s, defaultTarget string) []labelRule {
+	rules := make([]labelRule, 0)
+	for _, item := range splitList(s) {
+		rule := labelRule{Target: defaultTarget}
+		if i := strings.Index(item, "="); i >= 0 {
+			rule.Label, rule.Target = item[:i], item[i+1:]
+		} else {
+			rule.Label = item
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func initLabelRules() error {
+	if labelAllow != "" {
+		re, err := regexp.Compile(labelAllow)
+		if err != nil {
+			return fmt.Errorf("Invalid label allowlist '%s': %s", labelAllow, err)
+		}
+		allowedLabels = re
+	}
+
+	tagRules = parseLabelRules(labelTagRules, DEFAULT_TAG_FORMAT)
+	metaRules = parseLabelRules(labelMetaRules, "")
+
+	for _, rule := range append(tagRules, metaRules...) {
+		if rule.Label == "" {
+			return fmt.Errorf("Label mapping rule without label in '%s=%s'", rule.Label, rule.Target)
+		}
+	}
+
+	return nil
+}
+
+func isLabelAllowed(key string) bool {
+	return allowedLabels == nil || allowedLabels.MatchString(key)
+}
+
+// matchingLabels returns the allowed labels a rule applies to, sorted by key.
+func (r labelRule) matchingLabels(labels map[string]string) []string {
+	keys := make([]string, 0)
+	for key := range labels {
+		if (r.Label == ANY_LABEL || r.Label == key) && isLabelAllowed(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func labelTags(labels map[string]string) []string {
+	tags := make([]string, 0)
+	for _, rule := range tagRules {
+		for _, key := range rule.matchingLabels(labels) {
+			tag := strings.Replace(rule.Target, "{key}", key, -1)
+			tag = strings.Replace(tag, "{value}", labels[key], -1)
+			if !inSlice(tag, tags) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+func labelMeta(labels map[string]string) map[string]string {
+	meta := make(map[string]string)
+	for _, rule := range metaRules {
+		for _, key := range rule.matchingLabels(labels) {
+			// The target of ANY_LABEL rules is a prefix of the label key
+			target := rule.Target
+			if rule.Label == ANY_LABEL {
+				target += key
+			} else if target == "" {
+				target = key
+			}
+			meta[metaKey(target)] = labels[key]
+		}
+	}
+	return meta
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lightcode/kube2consul/core"
+)
+
+const (
+	META_NODE       = "k8s-node"
+	META_ZONE       = "k8s-zone"
+	META_REGION     = "k8s-region"
+	META_POD_PREFIX = "k8s-pod-"
+)
+
+var (
+	metaPodLabels string
+	metaNode      bool
+	metaTopology  bool
+	metaTags      bool
+
+	invalidMetaKeyChars = regexp.MustCompile("[^a-zA-Z0-9_-]")
+)
+
+func init() {
+	flag.StringVar(&metaPodLabels, "meta-pod-labels", "", "Comma separated list of pod labels added to the Consul service Meta")
+	flag.BoolVar(&metaNode, "meta-node", false, "Add the node name of each instance to the Consul service Meta")
+	flag.BoolVar(&metaTopology, "meta-topology", false, "Add the zone and region of each instance to the Consul service Meta")
+	flag.BoolVar(&metaTags, "meta-tags", false, "Add the pod and node metadata to the Consul service tags as key=value")
+}
+
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func metadataEnabled() bool {
+	return metaPodLabels != "" || metaNode || metaTopology
+}
+
+// metaKey turns any string into a valid Consul Meta key.
+func metaKey(s string) string {
+	return invalidMetaKeyChars.ReplaceAllString(s, "_")
+}
+
+// instanceMetadata returns the Meta of an instance from its pod and node.
+func (sp *ServicePlugin) instanceMetadata(inst instance) map[string]string {
+	meta := make(map[string]string)
+
+	if !metadataEnabled() {
+		return meta
+	}
+
+	nodeName, zone := inst.Endpoint.NodeName, inst.Endpoint.Zone
+
+	if ref := inst.Endpoint.TargetRef; ref != nil && ref.Kind == "Pod" {
+		if pod, ok := sp.pm.Metadata.GetPod(ref.Namespace, ref.Name); ok {
+			for _, label := range splitList(metaPodLabels) {
+				if value, ok := pod.Labels[label]; ok {
+					meta[META_POD_PREFIX+metaKey(label)] = value
+				}
+			}
+
+			if nodeName == "" {
+				nodeName = pod.Spec.NodeName
+			}
+		}
+	}
+
+	if metaNode && nodeName != "" {
+		meta[META_NODE] = nodeName
+	}
+
+	if metaTopology {
+		var region string
+		if node, ok := sp.pm.Metadata.GetNode(nodeName); ok {
+			nodeZone, nodeRegion := api.NodeTopology(node)
+			if zone == "" {
+				zone = nodeZone
+			}
+			region = nodeRegion
+		}
+
+		if zone != "" {
+			meta[META_ZONE] = zone
+		}
+		if region != "" {
+			meta[META_REGION] = region
+		}
+	}
+
+	return meta
+}
+
+// metadataTags returns the instance metadata as tags if they are enabled.
+func metadataTags(meta map[string]string) []string {
+	if !metaTags {
+		return []string{}
+	}
+	return keyValueTags(meta)
+}
+
+// keyValueTags returns a Meta as sorted key=value tags.
+func keyValueTags(meta map[string]string) []string {
+	tags := make([]string, 0, len(meta))
+	for key, value := range meta {
+		tags = append(tags, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// mergeMeta merges several Meta, the last ones taking precedence.
+func mergeMeta(metas ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, meta := range metas {
+		for key, value := range meta {
+			merged[key] = value
+		}
+	}
+	return merged
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"github.com/lightcode/kube2consul/core"
+	"github.com/lightcode/kube2consul/plugins"
+)
+
+// consul returns the backend of the Consul scope of a Kubernetes namespace.
+func (sp *ServicePlugin) consul(namespace string) *api.ConsulBackend {
+	return sp.pm.Consul.Scoped(plugins.ConsulScope(namespace))
+}
+
+// listAllServices lists the services of the agent in every managed
+// namespace.
+func (sp *ServicePlugin) listAllServices() map[string]*api.AgentService {
+	return plugins.ListAgentServices(sp.pm.Consul)
+}
+
+// agentServices holds the services of the agent listed in each scope, so
+// that a resync lists a scope once rather than once per service.
+type agentServices map[api.Scope]map[string]*api.AgentService
+
+// list returns the services of the agent in a scope, listing them on the
+// first call.
+func (listed agentServices) list(consul *api.ConsulBackend, scope api.Scope) map[string]*api.AgentService {
+	services, ok := listed[scope]
+	if !ok {
+		services = consul.ListServices()
+		listed[scope] = services
+	}
+	return services
+}
+
+// managedScopes returns the scopes kube2consul may have written in,
+// besides the ones of the current services.
+func (sp *ServicePlugin) managedScopes() []api.Scope {
+	return plugins.ManagedScopes(sp.pm.Consul)
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/lightcode/kube2consul/core"
+	"github.com/lightcode/kube2consul/plugins"
+)
+
+const (
+	// Registrations carry the UID of their Kubernetes service next to the
+	// owner Meta
+	META_UID = "k8s-uid"
+
+	// Adoption policies of the registrations that have no owner
+	ADOPT_NONE   = "none"
+	ADOPT_TAGGED = "tagged"
+	ADOPT_ALL    = "all"
+)
+
+var adoptPolicy string
+
+// Ownership of a registration
+const (
+	ownedByUs = iota
+	ownedByOther
+	notOwned
+)
+
+func init() {
+	flag.StringVar(&adoptPolicy, "adopt-policy", ADOPT_TAGGED, "Registrations without owner that are taken over: none, tagged (only those with the kube2consul tag) or all")
+}
+
+func checkAdoptPolicy() error {
+	if plugins.ClusterName == "" {
+		return fmt.Errorf("Cluster name can't be empty")
+	}
+
+	switch adoptPolicy {
+	case ADOPT_NONE, ADOPT_TAGGED, ADOPT_ALL:
+		return nil
+	default:
+		return fmt.Errorf("Unknown adopt policy '%s'", adoptPolicy)
+	}
+}
+
+func ownerMeta(svc Service) map[string]string {
+	return mergeMeta(plugins.OwnerMeta(), map[string]string{META_UID: svc.uid})
+}
+
+// registrationOwner tells who owns a registration. Registrations written by
+// another tool or by hand have no owner.
+func registrationOwner(service *api.AgentService) int {
+	if _, ok := service.Meta[plugins.META_CLUSTER]; !ok {
+		return notOwned
+	} else if !plugins.IsOwned(service.Meta) {
+		return ownedByOther
+	}
+	return ownedByUs
+}
+
+// isManaged tells if a registration can be updated and removed. The
+// registrations tagged by versions of kube2consul that didn't write the
+// owner are managed unless adoption is disabled.
+func isManaged(service *api.AgentService) bool {
+	switch registrationOwner(service) {
+	case ownedByUs:
+		return true
+	case notOwned:
+		return adoptPolicy != ADOPT_NONE && inSlice(SERVICES_TAG, service.Tags)
+	default:
+		return false
+	}
+}
+
+// canRegister tells if a registration with the ID of an existing one can
+// replace it.
+func canRegister(id string, registered map[string]*api.AgentService) bool {
+	service, ok := registered[id]
+	if !ok || isManaged(service) {
+		return true
+	}
+	return registrationOwner(service) == notOwned && adoptPolicy == ADOPT_ALL
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	"github.com/lightcode/kube2consul/core"
+)
+
+const (
+	ANNOTATION_EXPORT_PORTS  = "kube2consul/export-ports"
+	ANNOTATION_EXCLUDE_PORTS = "kube2consul/exclude-ports"
+
+	META_PROTOCOL     = "k8s-protocol"
+	META_APP_PROTOCOL = "k8s-app-protocol"
+)
+
+// Naming policies of unnamed ports
+const (
+	UNNAMED_PORT_EMPTY   = "empty"
+	UNNAMED_PORT_NUMBER  = "number"
+	UNNAMED_PORT_SERVICE = "service"
+)
+
+var unnamedPortPolicy string
+
+type servicePort struct {
+	Name        string        `json:"name"`
+	Port        int           `json:"port"`
+	Protocol    kapi.Protocol `json:"protocol"`
+	AppProtocol string        `json:"app_protocol,omitempty"`
+	TargetPort  string        `json:"target_port"`
+	NodePort    int           `json:"node_port,omitempty"`
+}
+
+func init() {
+	flag.StringVar(&unnamedPortPolicy, "unnamed-port-policy", UNNAMED_PORT_EMPTY, "Consul name of unnamed ports: <service>- (empty), <service>-<port> (number) or <service> (service)")
+}
+
+func checkUnnamedPortPolicy() error {
+	switch unnamedPortPolicy {
+	case UNNAMED_PORT_EMPTY, UNNAMED_PORT_NUMBER, UNNAMED_PORT_SERVICE:
+		return nil
+	default:
+		return fmt.Errorf("Unknown unnamed port policy '%s'", unnamedPortPolicy)
+	}
+}
+
+// portMatches tells if a port is in a list of port names or numbers.
+func portMatches(port kapi.ServicePort, list []string) bool {
+	return inSlice(port.Name, list) || inSlice(strconv.Itoa(port.Port), list)
+}
+
+// isPortExported applies the export and exclude annotations of a service.
+func isPortExported(svc kapi.Service, port kapi.ServicePort) bool {
+	if value, ok := svc.Annotations[ANNOTATION_EXPORT_PORTS]; ok && !portMatches(port, splitList(value)) {
+		return false
+	}
+
+	if value, ok := svc.Annotations[ANNOTATION_EXCLUDE_PORTS]; ok && portMatches(port, splitList(value)) {
+		return false
+	}
+
+	return true
+}
+
+// exportedPorts returns the exported ports of a service. The application
+// protocol is only known from EndpointSlices.
+func exportedPorts(svc kapi.Service, ep api.ServiceEndpoints) []servicePort {
+	appProtocols := make(map[string]string)
+	for _, subset := range ep.Subsets {
+		for _, port := range subset.Ports {
+			if port.AppProtocol != "" {
+				appProtocols[port.Name] = port.AppProtocol
+			}
+		}
+	}
+
+	ports := make([]servicePort, 0, len(svc.Spec.Ports))
+	for _, port := range svc.Spec.Ports {
+		if !isPortExported(svc, port) {
+			continue
+		}
+
+		ports = append(ports, servicePort{
+			Name:        port.Name,
+			Port:        port.Port,
+			Protocol:    port.Protocol,
+			AppProtocol: appProtocols[port.Name],
+			TargetPort:  port.TargetPort.String(),
+			NodePort:    port.NodePort,
+		})
+	}
+	return ports
+}
+
+// consulPortName returns the name of a port used in the Consul service name
+// and ID.
+func consulPortName(port servicePort) string {
+	if port.Name == "" && unnamedPortPolicy == UNNAMED_PORT_NUMBER {
+		return strconv.Itoa(port.Port)
+	}
+	return port.Name
+}
+
+func consulServiceName(serviceName string, port servicePort) string {
+	if port.Name == "" && unnamedPortPolicy == UNNAMED_PORT_SERVICE {
+		return serviceName
+	}
+	return fmt.Sprintf("%s-%s", serviceName, consulPortName(port))
+}
+
+// protocolMetadata returns the protocols of a port as Meta.
+func protocolMetadata(port servicePort) map[string]string {
+	meta := make(map[string]string)
+
+	protocol := port.Protocol
+	if protocol == "" {
+		protocol = kapi.ProtocolTCP
+	}
+	meta[META_PROTOCOL] = strings.ToLower(string(protocol))
+
+	if port.AppProtocol != "" {
+		meta[META_APP_PROTOCOL] = port.AppProtocol
+	}
+
+	return meta
+}
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/lightcode/kube2consul/core"
+	"github.com/lightcode/kube2consul/plugins"
+)
+
+const (
+	ANNOTATION_PREPARED_QUERY         = "kube2consul/prepared-query"
+	ANNOTATION_QUERY_FAILOVER_DCS     = "kube2consul/query-failover-datacenters"
+	ANNOTATION_QUERY_FAILOVER_NEAREST = "kube2consul/query-failover-nearest"
+	ANNOTATION_QUERY_NEAR             = "kube2consul/query-near"
+	ANNOTATION_QUERY_TAGS             = "kube2consul/query-tags"
+	ANNOTATION_QUERY_ONLY_PASSING     = "kube2consul/query-only-passing"
+)
+
+// ownedQuery is a prepared query created by kube2consul. Prepared queries
+// have no Meta, so their IDs are kept in the state KV at
+// <state prefix>/<cluster>/queries/<namespace>/<service>/<query name>.
+// service is the namespace/name of the Kubernetes service.
+type ownedQuery struct {
+	key     string
+	id      string
+	name    string
+	service string
+}
+
+// wantedQuery is a prepared query and the namespace/name of its Kubernetes
+// service.
+type wantedQuery struct {
+	service string
+	query   api.PreparedQuery
+}
+
+func queryKey(service, queryName string) string {
+	return plugins.StateKey("queries", service, queryName)
+}
+
+// preparedQueries returns the prepared queries of a service by name, one
+// per Consul service, when the service asks for them.
+func preparedQueries(svc Service) map[string]api.PreparedQuery {
+	queries := make(map[string]api.PreparedQuery)
+
+	if enabled, _ := strconv.ParseBool(svc.Annotations[ANNOTATION_PREPARED_QUERY]); !enabled {
+		return queries
+	}
+
+	scope := plugins.ConsulScope(svc.Namespace)
+	template := api.ServiceQuery{
+		Namespace: scope.Namespace,
+		Partition: scope.Partition,
+		Near:      svc.Annotations[ANNOTATION_QUERY_NEAR],
+		Failover: api.QueryFailover{
+			Datacenters: splitList(svc.Annotations[ANNOTATION_QUERY_FAILOVER_DCS]),
+		},
+	}
+
+	if len(template.Failover.Datacenters) == 0 {
+		template.Failover.Datacenters = nil
+	}
+	if tags := splitList(svc.Annotations[ANNOTATION_QUERY_TAGS]); len(tags) > 0 {
+		template.Tags = tags
+	}
+
+	if value, ok := svc.Annotations[ANNOTATION_QUERY_FAILOVER_NEAREST]; ok {
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			glog.Errorf("Invalid failover nearest '%s' of service %s", value, svc.Name)
+		} else {
+			template.Failover.NearestN = n
+		}
+	}
+
+	if value, ok := svc.Annotations[ANNOTATION_QUERY_ONLY_PASSING]; ok {
+		if onlyPassing, err := strconv.ParseBool(value); err != nil {
+			glog.Errorf("Invalid only passing '%s' of service %s", value, svc.Name)
+		} else {
+			template.OnlyPassing = onlyPassing
+		}
+	}
+
+	for name := range consulNames(svc) {
+		query := api.PreparedQuery{Name: name, Service: template}
+		query.Service.Service = name
+		queries[name] = query
+	}
+
+	return queries
+}
+
+// ownedQueries returns the prepared queries created for a service, or for
+// every service with allServices.
+func (sp *ServicePlugin) ownedQueries(key string) []ownedQuery {
+	root := plugins.StateKey("queries") + "/"
+	prefix := root
+	if key != allServices {
+		prefix += key + "/"
+	}
+
+	owned := make([]ownedQuery, 0)
+	for _, kp := range sp.pm.Consul.ListKV(prefix) {
+		s := strings.Split(strings.TrimPrefix(kp.Key, root), "/")
+		if len(s) != 3 {
+			continue
+		}
+		owned = append(owned, ownedQuery{key: kp.Key, id: string(kp.Value), service: serviceKey(s[0], s[1]), name: s[2]})
+	}
+	return owned
+}
+
+// applyQueries creates or updates the wanted queries that changed and
+// deletes the stale ones. Queries created by another tool or by hand are
+// never modified.
+func (sp *ServicePlugin) applyQueries(wanted map[string]wantedQuery, owned []ownedQuery, stale []ownedQuery) {
+	existing, err := sp.pm.Consul.ListPreparedQueries()
+	if err != nil {
+		sp.errors.Errorf("Cannot list prepared queries: %s", err)
+		return
+	}
+
+	byID := make(map[string]api.PreparedQuery, len(existing))
+	byName := make(map[string]api.PreparedQuery, len(existing))
+	for _, query := range existing {
+		byID[query.ID] = query
+		byName[query.Name] = query
+	}
+
+	ownedByName := make(map[string]ownedQuery, len(owned))
+	for _, o := range owned {
+		if w, ok := wanted[o.name]; ok && isServiceOwner(o.service, w.service) {
+			ownedByName[o.name] = o
+		}
+	}
+
+	for name, w := range wanted {
+		query := w.query
+
+		if o, ok := ownedByName[name]; ok {
+			if current, ok := byID[o.id]; ok {
+				query.ID = o.id
+				if current.Name == query.Name && reflect.DeepEqual(current.Service, query.Service) {
+					continue
+				}
+				if err := sp.pm.Consul.UpdatePreparedQuery(query); err != nil {
+					sp.errors.Errorf("Cannot update prepared query %s: %s", name, err)
+				}
+				continue
+			}
+		}
+
+		if _, ok := byName[name]; ok {
+			glog.Warningf("Prepared query %s is owned by another tool, skip it", name)
+			continue
+		}
+
+		id, err := sp.pm.Consul.CreatePreparedQuery(query)
+		if err != nil {
+			sp.errors.Errorf("Cannot create prepared query %s: %s", name, err)
+			continue
+		}
+		sp.pm.Consul.PutKV(queryKey(w.service, name), id)
+	}
+
+	for _, o := range stale {
+		if _, ok := byID[o.id]; ok {
+			if err := sp.pm.Consul.DeletePreparedQuery(o.id); err != nil {
+				sp.errors.Errorf("Cannot delete prepared query %s: %s", o.name, err)
+				continue
+			}
+		}
+		sp.pm.Consul.DeleteKV(o.key)
+	}
+}
+
+// staleQueries returns the owned queries that are not wanted.
+func staleQueries(wanted map[string]wantedQuery, owned []ownedQuery) []ownedQuery {
+	stale := make([]ownedQuery, 0)
+	for _, o := range owned {
+		if w, ok := wanted[o.name]; !ok || !isServiceOwner(o.service, w.service) {
+			stale = append(stale, o)
+		}
+	}
+	return stale
+}
+
+func wantedQueries(svc Service, wanted map[string]wantedQuery) {
+	for name, query := range preparedQueries(svc) {
+		wanted[name] = wantedQuery{service: serviceKey(svc.Namespace, svc.Name), query: query}
+	}
+}
+
+func (sp *ServicePlugin) updateServiceQueries(svc Service) {
+	wanted := make(map[string]wantedQuery)
+	wantedQueries(svc, wanted)
+
+	owned := sp.ownedQueries(serviceKey(svc.Namespace, svc.Name))
+	if len(wanted) == 0 && len(owned) == 0 {
+		return
+	}
+	sp.applyQueries(wanted, owned, staleQueries(wanted, owned))
+}
+
+func (sp *ServicePlugin) updateAllQueries(services ServiceList, approved bool) {
+	wanted := make(map[string]wantedQuery)
+	for _, svc := range services {
+		wantedQueries(svc, wanted)
+	}
+
+	owned := sp.ownedQueries(allServices)
+	if len(wanted) == 0 && len(owned) == 0 {
+		return
+	}
+
+	stale := staleQueries(wanted, owned)
+	if !sp.allowRemoval("prepared queries", len(stale), len(owned), len(wanted), approved) {
+		stale = nil
+	}
+	sp.applyQueries(wanted, owned, stale)
+
+	glog.Info("Consul prepared queries resynced")
+}
+
+func (sp *ServicePlugin) removeServiceQueries(namespace, serviceName string) {
+	if owned := sp.ownedQueries(serviceKey(namespace, serviceName)); len(owned) > 0 {
+		sp.applyQueries(nil, owned, owned)
+	}
+}
@@ -0,0 +1,248 @@
+package service
+
+import (
+	"flag"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	"github.com/lightcode/kube2consul/core"
+	"github.com/lightcode/kube2consul/plugins"
+)
+
+const ANNOTATION_MAX_CONNECTIONS = "kube2consul/max-connections"
+
+// Protocols known by Consul service mesh
+const (
+	PROTOCOL_TCP   = "tcp"
+	PROTOCOL_HTTP  = "http"
+	PROTOCOL_HTTP2 = "http2"
+	PROTOCOL_GRPC  = "grpc"
+)
+
+var writeServiceDefaults bool
+
+func init() {
+	flag.BoolVar(&writeServiceDefaults, "service-defaults", false, "Write the service-defaults config entries of the exported services")
+}
+
+// meshProtocol returns the Consul protocol of a port from its appProtocol,
+// or from its name prefix as in http-web or grpc.
+func meshProtocol(port servicePort) string {
+	switch strings.ToLower(port.AppProtocol) {
+	case PROTOCOL_HTTP, PROTOCOL_HTTP2, PROTOCOL_GRPC, PROTOCOL_TCP:
+		return strings.ToLower(port.AppProtocol)
+	case "kubernetes.io/h2c":
+		return PROTOCOL_HTTP2
+	}
+
+	name := strings.ToLower(port.Name)
+	for _, protocol := range []string{PROTOCOL_HTTP2, PROTOCOL_GRPC, PROTOCOL_HTTP} {
+		if name == protocol || strings.HasPrefix(name, protocol+"-") {
+			return protocol
+		}
+	}
+	return PROTOCOL_TCP
+}
+
+// serviceDefaults returns the service-defaults config entries of a service
+// by Consul service name.
+func serviceDefaults(svc Service) map[string]api.ServiceDefaults {
+	entries := make(map[string]api.ServiceDefaults)
+
+	var maxConnections int
+	if value, ok := svc.Annotations[ANNOTATION_MAX_CONNECTIONS]; ok {
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			glog.Errorf("Invalid max connections '%s' of service %s", value, svc.Name)
+		} else {
+			maxConnections = n
+		}
+	}
+
+	for name, port := range consulNames(svc) {
+		if port.Protocol == kapi.ProtocolUDP {
+			// Not supported by the service mesh
+			continue
+		}
+
+		entries[name] = api.ServiceDefaults{
+			Kind:                  api.ConfigEntryServiceDefaults,
+			Name:                  name,
+			Protocol:              meshProtocol(port),
+			MaxInboundConnections: maxConnections,
+			Meta:                  mergeMeta(ownerMeta(svc), serviceMeta(svc)),
+		}
+	}
+
+	return entries
+}
+
+// consulNames returns the Consul service names of a service and their port.
+func consulNames(svc Service) map[string]servicePort {
+	names := make(map[string]servicePort)
+
+	// Names only depend on the instance with some templates, the default
+	// names are known without any instance
+	instances := svc.instances
+	if len(instances) == 0 {
+		instances = []instance{{}}
+	}
+
+	for _, port := range svc.PortDetails {
+		for _, inst := range instances {
+			name, _, _, err := instanceNaming(svc, port, inst)
+			if err != nil {
+				glog.Errorf("Cannot generate name of service %s: %s", svc.Name, err)
+				continue
+			}
+			names[name] = port
+		}
+	}
+
+	return names
+}
+
+// isOwnedEntry tells if a config entry can be modified and removed.
+func isOwnedEntry(meta map[string]string) bool {
+	_, ok := meta[plugins.META_CLUSTER]
+	return plugins.IsOwned(meta) || (!ok && adoptPolicy == ADOPT_ALL)
+}
+
+func (sp *ServicePlugin) listServiceDefaults(consul *api.ConsulBackend) ([]api.ServiceDefaults, bool) {
+	entries := make([]api.ServiceDefaults, 0)
+	if err := consul.ListConfigEntries(api.ConfigEntryServiceDefaults, &entries); err != nil {
+		sp.errors.Errorf("Cannot list service-defaults config entries: %s", err)
+		return nil, false
+	}
+	return entries, true
+}
+
+// applyServiceDefaults writes the wanted entries that changed and removes
+// the stale ones.
+func (sp *ServicePlugin) applyServiceDefaults(consul *api.ConsulBackend, wanted map[string]api.ServiceDefaults, current []api.ServiceDefaults, stale []string) {
+	byName := make(map[string]api.ServiceDefaults, len(current))
+	for _, entry := range current {
+		byName[entry.Name] = entry
+	}
+
+	for name, entry := range wanted {
+		if existing, ok := byName[name]; ok && reflect.DeepEqual(existing, entry) {
+			continue
+		} else if ok && !isOwnedEntry(existing.Meta) {
+			glog.Warningf("Config entry service-defaults/%s is owned by another cluster or tool, skip it", name)
+			continue
+		}
+
+		if err := consul.SetConfigEntry(entry); err != nil {
+			sp.errors.Errorf("Cannot write config entry service-defaults/%s: %s", name, err)
+		}
+	}
+
+	for _, name := range stale {
+		if err := consul.DeleteConfigEntry(api.ConfigEntryServiceDefaults, name); err != nil {
+			sp.errors.Errorf("Cannot delete config entry service-defaults/%s: %s", name, err)
+		}
+	}
+}
+
+// staleServiceDefaults returns the owned entries of a service, or of every
+// service with allServices, that are not wanted, and the number of owned
+// entries.
+func staleServiceDefaults(wanted map[string]api.ServiceDefaults, current []api.ServiceDefaults, key string) (stale []string, managed int) {
+	stale = make([]string, 0)
+
+	for _, entry := range current {
+		if !plugins.IsOwned(entry.Meta) {
+			continue
+		} else if owner, _ := metaOwner(entry.Meta); !isServiceOwner(owner, key) {
+			continue
+		}
+
+		managed++
+		if _, ok := wanted[entry.Name]; !ok {
+			stale = append(stale, entry.Name)
+		}
+	}
+
+	return stale, managed
+}
+
+func (sp *ServicePlugin) updateServiceDefaults(svc Service) {
+	if !writeServiceDefaults {
+		return
+	}
+
+	consul := sp.consul(svc.Namespace)
+	current, ok := sp.listServiceDefaults(consul)
+	if !ok {
+		return
+	}
+
+	wanted := serviceDefaults(svc)
+	stale, _ := staleServiceDefaults(wanted, current, serviceKey(svc.Namespace, svc.Name))
+	sp.applyServiceDefaults(consul, wanted, current, stale)
+}
+
+func (sp *ServicePlugin) updateAllServiceDefaults(services ServiceList, approved bool) {
+	if !writeServiceDefaults {
+		return
+	}
+
+	wanted := make(map[api.Scope]map[string]api.ServiceDefaults)
+	for _, scope := range sp.managedScopes() {
+		wanted[scope] = make(map[string]api.ServiceDefaults)
+	}
+	for _, svc := range services {
+		scope := plugins.ConsulScope(svc.Namespace)
+		if _, ok := wanted[scope]; !ok {
+			wanted[scope] = make(map[string]api.ServiceDefaults)
+		}
+		for name, entry := range serviceDefaults(svc) {
+			wanted[scope][name] = entry
+		}
+	}
+
+	// The guard applies to the entries of every scope together, a scope
+	// without any wanted entry being expected
+	current := make(map[api.Scope][]api.ServiceDefaults)
+	stale := make(map[api.Scope][]string)
+	var removed, managed, total int
+	for scope := range wanted {
+		entries, ok := sp.listServiceDefaults(sp.pm.Consul.Scoped(scope))
+		if !ok {
+			continue
+		}
+		current[scope] = entries
+
+		scopeStale, scopeManaged := staleServiceDefaults(wanted[scope], entries, allServices)
+		stale[scope] = scopeStale
+		removed += len(scopeStale)
+		managed += scopeManaged
+		total += len(wanted[scope])
+	}
+
+	allowed := sp.allowRemoval("config entries", removed, managed, total, approved)
+	for scope, entries := range current {
+		if !allowed {
+			stale[scope] = nil
+		}
+		sp.applyServiceDefaults(sp.pm.Consul.Scoped(scope), wanted[scope], entries, stale[scope])
+	}
+
+	glog.Info("Consul config entries resynced")
+}
+
+func (sp *ServicePlugin) removeServiceDefaults(namespace, serviceName string) {
+	if !writeServiceDefaults {
+		return
+	}
+
+	consul := sp.consul(namespace)
+	if current, ok := sp.listServiceDefaults(consul); ok {
+		stale, _ := staleServiceDefaults(nil, current, serviceKey(namespace, serviceName))
+		sp.applyServiceDefaults(consul, nil, current, stale)
+	}
+}
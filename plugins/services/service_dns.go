@@ -1,13 +1,29 @@
 package service
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"strings"
 
 	"github.com/golang/glog"
+
+	"github.com/lightcode/kube2consul/core"
+	"github.com/lightcode/kube2consul/plugins"
 )
 
-const allServices = ""
+const (
+	allServices = ""
+
+	// Name and namespace of the Kubernetes service of a registration, whose
+	// ID can't be parsed when it comes from a template
+	META_SERVICE   = "k8s-service"
+	META_NAMESPACE = "k8s-namespace"
+
+	// Hash of the registration, to skip the registrations that didn't change
+	META_HASH = "k8s-hash"
+)
 
 func inSlice(value string, slice []string) bool {
 	for _, s := range slice {
@@ -18,7 +34,10 @@ func inSlice(value string, slice []string) bool {
 	return false
 }
 
+// IPv6 colons are replaced by dashes in service IDs, which can't be found
+// in an IP address, so the ID stays reversible.
 func generateServiceID(serviceName, portName, ipAddress string) string {
+	ipAddress = strings.Replace(canonicalIP(ipAddress), ":", "-", -1)
 	return fmt.Sprintf("svc~%s~%s~%s", serviceName, portName, ipAddress)
 }
 
@@ -28,76 +47,277 @@ func parseServiceID(id string) (serviceName, portName, ipAddress string, err err
 	if len(s) != 4 {
 		err = fmt.Errorf("Cannot parse service ID '%s'", id)
 	} else {
-		serviceName, portName, ipAddress = s[1], s[2], s[3]
+		serviceName, portName = s[1], s[2]
+		ipAddress = strings.Replace(s[3], "-", ":", -1)
 	}
 
 	return
 }
 
-func (sp *ServicePlugin) updateServiceDNS(svc Service) (ids []string) {
-	ids = make([]string, 0)
+func taggedAddresses(inst instance, port int) map[string]api.ServiceAddress {
+	addresses := make(map[string]api.ServiceAddress)
+
+	for _, ip := range []string{inst.Address, inst.AlternateAddress} {
+		if ip == "" {
+			continue
+		} else if isIPv6(ip) {
+			addresses["lan_ipv6"] = api.ServiceAddress{Address: ip, Port: port}
+		} else {
+			addresses["lan_ipv4"] = api.ServiceAddress{Address: ip, Port: port}
+		}
+	}
+
+	return addresses
+}
+
+// registrationRef identifies a registration across the managed namespaces.
+type registrationRef struct {
+	ID    string
+	Scope api.Scope
+}
+
+// serviceKey identifies a Kubernetes service across namespaces.
+func serviceKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// serviceMeta returns the Meta recording the Kubernetes service of a Consul
+// object.
+func serviceMeta(svc Service) map[string]string {
+	return map[string]string{
+		META_SERVICE:   svc.Name,
+		META_NAMESPACE: svc.Namespace,
+	}
+}
+
+// metaOwner returns the Kubernetes service recorded in the Meta of a Consul
+// object, as namespace/name or as a bare name when it was written before
+// the namespace was recorded.
+func metaOwner(meta map[string]string) (owner string, ok bool) {
+	name, ok := meta[META_SERVICE]
+	if !ok {
+		return "", false
+	} else if namespace, ok := meta[META_NAMESPACE]; ok {
+		return serviceKey(namespace, name), true
+	}
+	return name, true
+}
+
+// isServiceOwner tells if owner, as returned by metaOwner, is the service
+// key or allServices. A bare name matches the service of every namespace.
+func isServiceOwner(owner, key string) bool {
+	if key == allServices || owner == key {
+		return true
+	}
+	return !strings.Contains(owner, "/") && owner == key[strings.Index(key, "/")+1:]
+}
+
+// serviceOwner returns the Kubernetes service of a registration.
+func serviceOwner(id string, service *api.AgentService) (string, error) {
+	if owner, ok := metaOwner(service.Meta); ok {
+		return owner, nil
+	}
+
+	name, _, _, err := parseServiceID(id)
+	return name, err
+}
+
+// registrationHash returns the hash of a registration without its META_HASH.
+func registrationHash(registration *api.ServiceRegistration) string {
+	r := *registration
+	r.Meta = make(map[string]string, len(registration.Meta))
+	for key, value := range registration.Meta {
+		if key != META_HASH {
+			r.Meta[key] = value
+		}
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		glog.Errorf("Cannot hash registration %s: %s", registration.ID, err)
+		return ""
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// isRegistered tells if a registration is already in Consul, unchanged.
+func isRegistered(registration *api.ServiceRegistration, registered map[string]*api.AgentService) bool {
+	service, ok := registered[registration.ID]
+	return ok && service.Meta[META_HASH] != "" && service.Meta[META_HASH] == registration.Meta[META_HASH]
+}
+
+// serviceRegistrations returns the Consul registrations of every instance
+// and port of a service.
+func (sp *ServicePlugin) serviceRegistrations(svc Service) []*api.ServiceRegistration {
+	registrations := make([]*api.ServiceRegistration, 0)
 
-	for _, ipAddress := range svc.Endpoints {
-		for portName, portNumber := range svc.Ports {
-			id := generateServiceID(svc.Name, portName, ipAddress)
-			sp.pm.Consul.AddService(
-				id,
-				fmt.Sprintf("%s-%s", svc.Name, portName),
-				ipAddress,
-				portNumber,
-				[]string{SERVICES_TAG},
-			)
-			ids = append(ids, id)
+	scope := plugins.ConsulScope(svc.Namespace)
+
+	connect, err := parseConnect(svc)
+	if err != nil {
+		glog.Errorf("Cannot register service %s in Connect: %s", svc.Name, err)
+	}
+
+	for _, inst := range svc.instances {
+		if sp.isTerminating(inst) {
+			continue
 		}
+
+		instanceMeta := sp.instanceMetadata(inst)
+		weights := sp.instanceWeights(svc, inst)
+
+		for i, port := range svc.PortDetails {
+			protocolMeta := protocolMetadata(port)
+
+			name, id, templateTags, err := instanceNaming(svc, port, inst)
+			if err != nil {
+				glog.Errorf("Cannot generate name of service %s: %s", svc.Name, err)
+				continue
+			}
+
+			tags := append([]string{SERVICES_TAG}, svc.tags...)
+			tags = append(tags, metadataTags(instanceMeta)...)
+			tags = append(tags, keyValueTags(protocolMeta)...)
+			tags = append(tags, templateTags...)
+
+			registration := &api.ServiceRegistration{
+				ID:              id,
+				Name:            name,
+				Address:         inst.Address,
+				Port:            port.Port,
+				Tags:            tags,
+				TaggedAddresses: taggedAddresses(inst, port.Port),
+				Meta:            mergeMeta(svc.meta, instanceMeta, protocolMeta, ownerMeta(svc), serviceMeta(svc)),
+				Weights:         weights,
+				Namespace:       scope.Namespace,
+				Partition:       scope.Partition,
+			}
+
+			var sidecar *api.ServiceRegistration
+			if connect != nil && connect.mode == CONNECT_NATIVE {
+				registration.Connect = &api.AgentServiceConnect{Native: true}
+			} else if connect != nil {
+				sidecar = connect.sidecarRegistration(registration, inst, connect.sidecarPort(port, i))
+			}
+
+			registration.Meta[META_HASH] = registrationHash(registration)
+			registrations = append(registrations, registration)
+
+			if sidecar != nil {
+				sidecar.Meta[META_HASH] = registrationHash(sidecar)
+				registrations = append(registrations, sidecar)
+			}
+		}
+	}
+
+	return registrations
+}
+
+// updateServiceDNS registers the instances of a service and returns their
+// IDs, listed holding the services of the agent already listed. The stale
+// registrations are left to the caller: removed at once after an event, or
+// through the mass removal guard by a resync.
+func (sp *ServicePlugin) updateServiceDNS(svc Service, listed agentServices) (ids []string) {
+	ids = make([]string, 0)
+
+	registrations := sp.serviceRegistrations(svc)
+
+	wanted := make([]string, 0, len(registrations))
+	for _, registration := range registrations {
+		wanted = append(wanted, registration.ID)
 	}
+	suppressed := sp.trackFlaps(serviceKey(svc.Namespace, svc.Name), wanted)
+
+	scope := plugins.ConsulScope(svc.Namespace)
+	consul := sp.pm.Consul.Scoped(scope)
+	registered := listed.list(consul, scope)
 
-	sp.cleanDNS(ids, svc.Name)
+	for _, registration := range registrations {
+		if suppressed[registration.ID] {
+			continue
+		} else if !canRegister(registration.ID, registered) {
+			glog.Warningf("Service %s is owned by another cluster or tool, skip registration", registration.ID)
+			continue
+		}
+
+		// Registering an unchanged service still wakes up the blocking
+		// queries and anti-entropy of the cluster
+		if !isRegistered(registration, registered) {
+			consul.AddService(registration)
+		}
+		sp.undrainService(registrationRef{ID: registration.ID, Scope: scope})
+		ids = append(ids, registration.ID)
+	}
 
 	return ids
 }
 
-func (sp *ServicePlugin) updateDNS(services ServiceList) {
+// updateDNS resyncs the registrations and returns how many are registered.
+// The stale registrations of every service, including those of a service
+// whose endpoints went missing, are removed together so that the mass
+// removal guard applies to them.
+func (sp *ServicePlugin) updateDNS(services ServiceList, approved bool) int {
 	ids := make([]string, 0)
+	listed := make(agentServices)
 
 	for _, svc := range services {
-		ids = append(ids, sp.updateServiceDNS(svc)...)
+		ids = append(ids, sp.updateServiceDNS(svc, listed)...)
 	}
 
-	sp.cleanDNS(ids, allServices)
+	stale, managed := sp.staleServices(ids, allServices)
+	if sp.allowRemoval("services", len(stale), managed, len(ids), approved) {
+		for _, ref := range stale {
+			sp.drainService(ref)
+		}
+	}
 
 	glog.Info("Consul services resynced")
+	return len(ids)
 }
 
-// serviceName peut être égale à un nom de service ou à allServices
-func (sp *ServicePlugin) cleanDNS(ids []string, serviceName string) {
-	invalidEntries := make([]string, 0)
+// staleServices returns the managed services of every managed namespace
+// that are not in ids, and the number of services managed.
+// key peut être égale à namespace/nom d'un service ou à allServices
+func (sp *ServicePlugin) staleServices(ids []string, key string) (invalidEntries []registrationRef, managed int) {
+	invalidEntries = make([]registrationRef, 0)
 
-	for id, kp := range sp.pm.Consul.ListServices() {
-		if !inSlice(SERVICES_TAG, kp.Tags) {
+	for id, kp := range sp.listAllServices() {
+		ref := registrationRef{ID: id, Scope: plugins.RegistrationScope(kp)}
+
+		if !isManaged(kp) {
 			// Le service n'est pas managé par kube2consul
 			continue
 		}
 
-		if serviceName != allServices {
-			if name, _, _, err := parseServiceID(id); err != nil {
-				invalidEntries = append(invalidEntries, id)
+		if key != allServices {
+			if owner, err := serviceOwner(id, kp); err != nil {
+				invalidEntries = append(invalidEntries, ref)
 				continue
-			} else if name != serviceName {
+			} else if !isServiceOwner(owner, key) {
 				continue
 			}
 		}
 
+		managed++
 		if !inSlice(id, ids) {
-			invalidEntries = append(invalidEntries, id)
+			invalidEntries = append(invalidEntries, ref)
 		}
 	}
 
-	for _, id := range invalidEntries {
-		glog.Infof("Remove service '%s' in Consul", id)
-		sp.pm.Consul.RemoveService(id)
+	return invalidEntries, managed
+}
+
+// key peut être égale à namespace/nom d'un service ou à allServices
+func (sp *ServicePlugin) cleanDNS(ids []string, key string) {
+	invalidEntries, _ := sp.staleServices(ids, key)
+
+	for _, ref := range invalidEntries {
+		sp.drainService(ref)
 	}
 }
 
-func (sp *ServicePlugin) removeServiceDNS(serviceName string) {
-	sp.cleanDNS([]string{}, serviceName)
+func (sp *ServicePlugin) removeServiceDNS(key string) {
+	sp.cleanDNS([]string{}, key)
 }
@@ -1,47 +1,285 @@
 package service
 
 import (
-	"encoding/json"
-	"fmt"
+	"bytes"
+	"flag"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/lightcode/kube2consul/core"
+	"github.com/lightcode/kube2consul/plugins"
 )
 
-func (sp *ServicePlugin) updateServiceKV(svc Service) {
-	obj, _ := json.Marshal(svc)
-	sp.pm.Consul.PutKV(fmt.Sprintf("%s/%s", SERVICES_ROOT, svc.Name), string(obj))
+const (
+	// Number of attempts of a check-and-set update modified concurrently
+	kvCASAttempts = 3
+
+	kvWatchRetryInterval = time.Second * 5
+)
+
+var kvRepair bool
+
+func init() {
+	flag.BoolVar(&kvRepair, "kv-repair", true, "Watch the services KV and repair the values modified or deleted out of band")
+}
+
+// kvOps returns the check-and-set operations turning the current values into
+// the desired ones and deleting the removed keys. The values are written
+// acquiring their key when session isn't empty. Unchanged values are
+// skipped, unless they have to be acquired again.
+func kvOps(desired map[string][]byte, removed []string, current map[string]*consulapi.KVPair, session string) []api.KVOp {
+	keys := make([]string, 0, len(desired))
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	ops := make([]api.KVOp, 0)
+
+	for _, key := range keys {
+		op := api.KVOp{Verb: api.KVCAS, Key: key, Value: desired[key], Session: session}
+		if kp, ok := current[key]; ok {
+			if bytes.Equal(kp.Value, desired[key]) && (session == "" || kp.Session == session) {
+				continue
+			}
+			op.Index = kp.ModifyIndex
+		}
+		ops = append(ops, op)
+	}
+
+	for _, key := range removed {
+		if kp, ok := current[key]; ok {
+			ops = append(ops, api.KVOp{Verb: api.KVDeleteCAS, Key: key, Index: kp.ModifyIndex})
+		}
+	}
+
+	return ops
+}
+
+func kvPairsByKey(pairs consulapi.KVPairs) map[string]*consulapi.KVPair {
+	byKey := make(map[string]*consulapi.KVPair, len(pairs))
+	for _, kp := range pairs {
+		byKey[kp.Key] = kp
+	}
+	return byKey
 }
 
-func (sp *ServicePlugin) updateKV(services ServiceList) {
-	for _, kp := range sp.pm.Consul.ListKV(SERVICES_ROOT) {
-		s := strings.Split(kp.Key, "/")
-		serviceName := s[len(s)-1]
-		if _, ok := services[serviceName]; !ok {
-			sp.pm.Consul.DeleteKV(kp.Key)
+// currentKV reads the current values of some keys.
+func currentKV(consul *api.ConsulBackend, keys []string) map[string]*consulapi.KVPair {
+	current := make(map[string]*consulapi.KVPair)
+	for _, key := range keys {
+		if kp, err := consul.GetKV(key); err != nil {
+			glog.Errorf("Cannot get value %s: %s", key, err)
+		} else if kp != nil {
+			current[key] = kp
 		}
 	}
+	return current
+}
+
+// casKV applies the operations computed by ops on fresh values until no key
+// is modified concurrently.
+func (sp *ServicePlugin) casKV(consul *api.ConsulBackend, ops func() []api.KVOp) {
+	for attempt := 1; ; attempt++ {
+		err := consul.ApplyKV(ops())
+		if err == nil {
+			return
+		} else if attempt == kvCASAttempts || err == api.ErrNoSession {
+			sp.errors.Errorf("Cannot update KV after %d attempts: %s", attempt, err)
+			return
+		}
+	}
+}
+
+func (sp *ServicePlugin) setDesiredKV(scope api.Scope, values map[string][]byte, removed []string) {
+	sp.Lock()
+	if _, ok := sp.desiredKV[scope]; !ok {
+		sp.desiredKV[scope] = make(map[string][]byte)
+	}
+	for key, value := range values {
+		sp.desiredKV[scope][key] = value
+	}
+	for _, key := range removed {
+		delete(sp.desiredKV[scope], key)
+	}
+	sp.Unlock()
+
+	sp.watchKV(scope)
+}
+
+// currentServiceKV reads the current values of a service.
+func currentServiceKV(consul *api.ConsulBackend, svc Service) map[string]*consulapi.KVPair {
+	if kvLayout == KV_LAYOUT_FLAT {
+		return kvPairsByKey(consul.ListKV(serviceKVDir(svc.Namespace, svc.Name)))
+	}
+	return currentKV(consul, []string{serviceKVKey(svc.Namespace, svc.Name)})
+}
+
+// staleKeys returns the current keys that are not desired anymore.
+func staleKeys(desired map[string][]byte, current map[string]*consulapi.KVPair) []string {
+	stale := make([]string, 0)
+	for key := range current {
+		if _, ok := desired[key]; !ok {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+func (sp *ServicePlugin) updateServiceKV(svc Service) {
+	values := sp.serviceKV(svc)
+	scope := plugins.ConsulScope(svc.Namespace)
+	consul := sp.pm.Consul.Scoped(scope)
+
+	sp.casKV(consul, func() []api.KVOp {
+		current := currentServiceKV(consul, svc)
+		values := keepLastSynced(values, current)
+		stale := staleKeys(values, current)
+		sp.setDesiredKV(scope, values, stale)
+		return kvOps(values, stale, current, consul.Session())
+	})
+}
+
+// updateKV resyncs the KV of every managed namespace.
+func (sp *ServicePlugin) updateKV(services ServiceList, approved bool) {
+	desired := make(map[api.Scope]map[string][]byte)
+	for _, scope := range sp.managedScopes() {
+		desired[scope] = make(map[string][]byte)
+	}
 
 	for _, svc := range services {
-		sp.updateServiceKV(svc)
+		scope := plugins.ConsulScope(svc.Namespace)
+		if _, ok := desired[scope]; !ok {
+			desired[scope] = make(map[string][]byte)
+		}
+		for key, value := range sp.serviceKV(svc) {
+			desired[scope][key] = value
+		}
+	}
+
+	sp.Lock()
+	sp.desiredKV = desired
+	sp.Unlock()
+
+	// A scope without any wanted value isn't an empty list, the empty list
+	// guard applies to the values of every scope together
+	var wanted int
+	for _, values := range desired {
+		wanted += len(values)
+	}
+
+	for scope, values := range desired {
+		sp.watchKV(scope)
+
+		consul := sp.pm.Consul.Scoped(scope)
+		sp.casKV(consul, func() []api.KVOp {
+			current := kvPairsByKey(consul.ListKV(kvPrefix + "/"))
+			values := keepLastSynced(values, current)
+			sp.setDesiredKV(scope, values, nil)
+			stale := staleKeys(values, current)
+
+			if !sp.allowRemoval("KV keys", len(stale), len(current), wanted, approved) {
+				stale = nil
+			}
+
+			return kvOps(values, stale, current, consul.Session())
+		})
 	}
 
 	glog.Info("Consul KV resynced")
 }
 
-func (sp *ServicePlugin) getServiceKV(serviceName string) (svc Service, _ error) {
-	key := fmt.Sprintf("%s/%s", SERVICES_ROOT, serviceName)
+func (sp *ServicePlugin) removeServiceKV(namespace, serviceName string) {
+	scope := plugins.ConsulScope(namespace)
+	consul := sp.pm.Consul.Scoped(scope)
 
-	if kp, err := sp.pm.Consul.GetKV(key); err != nil {
-		return svc, err
-	} else if err := json.Unmarshal(kp.Value, &svc); err != nil {
-		return svc, err
-	} else {
-		return svc, nil
+	if kvLayout == KV_LAYOUT_FLAT {
+		dir := serviceKVDir(namespace, serviceName)
+
+		sp.Lock()
+		for key := range sp.desiredKV[scope] {
+			if strings.HasPrefix(key, dir) {
+				delete(sp.desiredKV[scope], key)
+			}
+		}
+		sp.Unlock()
+
+		consul.DeleteKVTree(dir)
+		return
 	}
+
+	key := serviceKVKey(namespace, serviceName)
+	sp.setDesiredKV(scope, nil, []string{key})
+	consul.DeleteKV(key)
 }
 
-func (sp *ServicePlugin) removeServiceKV(serviceName string) {
-	key := fmt.Sprintf("%s/%s", SERVICES_ROOT, serviceName)
-	sp.pm.Consul.DeleteKV(key)
+// watchKV starts repairing the KV of a scope, once per scope.
+func (sp *ServicePlugin) watchKV(scope api.Scope) {
+	if !kvRepair {
+		return
+	}
+
+	sp.Lock()
+	watched := sp.watchedKV[scope]
+	sp.watchedKV[scope] = true
+	sp.Unlock()
+
+	if !watched {
+		go sp.repairKVLoop(scope)
+	}
+}
+
+// repairKVLoop repairs the values modified or deleted out of band as soon as
+// Consul reports a change under the KV prefix, until the plugin stops.
+func (sp *ServicePlugin) repairKVLoop(scope api.Scope) {
+	var index uint64
+
+	consul := sp.pm.Consul.Scoped(scope)
+
+	for {
+		pairs, lastIndex, err := consul.WatchKV(kvPrefix+"/", index)
+		if sp.pm.Stopped() {
+			return
+		} else if err != nil {
+			glog.Errorf("Cannot watch KV %s: %s", kvPrefix, err)
+			time.Sleep(kvWatchRetryInterval)
+			continue
+		}
+
+		if lastIndex < index {
+			// Consul index was reset
+			index = 0
+			continue
+		} else if lastIndex == index {
+			continue
+		}
+		index = lastIndex
+
+		sp.repairKV(consul, scope, kvPairsByKey(pairs))
+	}
+}
+
+func (sp *ServicePlugin) repairKV(consul *api.ConsulBackend, scope api.Scope, current map[string]*consulapi.KVPair) {
+	sp.Lock()
+	desired := make(map[string][]byte, len(sp.desiredKV[scope]))
+	for key, value := range sp.desiredKV[scope] {
+		desired[key] = value
+	}
+	sp.Unlock()
+
+	ops := kvOps(desired, nil, current, consul.Session())
+	if len(ops) == 0 {
+		return
+	}
+
+	glog.Infof("Repair %d KV values modified out of band", len(ops))
+	if err := consul.ApplyKV(ops); err != nil {
+		// The next change will be repaired by the next watch iteration
+		sp.errors.Errorf("Cannot repair KV: %s", err)
+	}
 }
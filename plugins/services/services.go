@@ -1,10 +1,15 @@
 package service
 
 import (
+	"net/http"
+	"sync"
+	"time"
+
 	"github.com/golang/glog"
 	kapi "k8s.io/kubernetes/pkg/api"
 	"k8s.io/kubernetes/pkg/watch"
 
+	"github.com/lightcode/kube2consul/core"
 	"github.com/lightcode/kube2consul/plugins"
 )
 
@@ -13,35 +18,158 @@ const (
 	SERVICES_TAG  = "kube2consul-service-managed"
 )
 
+// ServiceList holds services by namespace/name, see serviceKey
 type ServiceList map[string]Service
 
 type ServicePlugin struct {
 	pm *plugins.PluginManager
+
+	// Last known Kubernetes objects by namespace/name, used to rebuild a
+	// Service when only one of them changes.
+	kubeServices  map[string]kapi.Service
+	kubeEndpoints map[string]api.ServiceEndpoints
+
+	// Namespace/name -> time of the last event of the service or its
+	// endpoints, the objects of the watch being more recent than the ones
+	// of the database listed before
+	kubeUpdated map[string]time.Time
+
+	// Registration -> start of the drain
+	draining map[registrationRef]time.Time
+
+	// Service namespace/name -> debounced update
+	pending map[string]*time.Timer
+
+	// Consul service ID -> registration history
+	flaps map[string]*flapState
+
+	// Pod namespace/name -> last known weight annotations
+	weightAnnotations map[string]string
+
+	// Removals of the next resync approved by an administrator
+	approval *plugins.RemovalApproval
+
+	// KV values written by kube2consul by scope, restored when modified
+	// out of band
+	desiredKV map[api.Scope]map[string][]byte
+
+	// Scopes whose KV is watched for repairs
+	watchedKV map[api.Scope]bool
+
+	// Result of the last resync and errors since the last report, reported
+	// in the status document
+	report plugins.PluginReport
+	errors plugins.ErrorLog
+
+	sync.Mutex
 }
 
+// Service is the document written in KV. Fields are only added to it, any
+// other change must increase SERVICE_SCHEMA.
 type Service struct {
+	Schema      int               `json:"schema"`
 	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Labels      map[string]string `json:"labels"`
 	Annotations map[string]string `json:"annotations"`
 	Endpoints   []string          `json:"endpoints"`
 	Ports       map[string]int    `json:"ports"`
+
+	Type                string                     `json:"type"`
+	ClusterIPs          []string                   `json:"cluster_ips"`
+	SessionAffinity     string                     `json:"session_affinity"`
+	LoadBalancerIngress []kapi.LoadBalancerIngress `json:"load_balancer_ingress"`
+	PortDetails         []servicePort              `json:"port_details"`
+	EndpointDetails     []EndpointDetail           `json:"endpoint_details"`
+
+	Generation      int64     `json:"generation"`
+	ResourceVersion string    `json:"resource_version"`
+	LastSynced      time.Time `json:"lastSynced"`
+
+	uid       string
+	instances []instance
+	tags      []string
+	meta      map[string]string
+}
+
+func newServicePlugin() plugins.Plugin {
+	sp := &ServicePlugin{
+		kubeServices:      make(map[string]kapi.Service),
+		kubeEndpoints:     make(map[string]api.ServiceEndpoints),
+		kubeUpdated:       make(map[string]time.Time),
+		draining:          make(map[registrationRef]time.Time),
+		pending:           make(map[string]*time.Timer),
+		flaps:             make(map[string]*flapState),
+		weightAnnotations: make(map[string]string),
+		desiredKV:         make(map[api.Scope]map[string][]byte),
+		watchedKV:         make(map[api.Scope]bool),
+		approval:          plugins.NewRemovalApproval(),
+	}
+
+	return sp
 }
 
 func init() {
-	s := new(ServicePlugin)
-	plugins.Register("services", s)
+	http.HandleFunc("/admin/services/approve-removal", handleApproval)
+	plugins.Register("services", newServicePlugin)
 }
 
 func (sp *ServicePlugin) Initialize(pm *plugins.PluginManager) {
 	sp.pm = pm
 
+	if err := checkAddressFamily(); err != nil {
+		glog.Fatalln(err)
+	}
+
+	if err := checkUnnamedPortPolicy(); err != nil {
+		glog.Fatalln(err)
+	}
+
+	if err := initLabelRules(); err != nil {
+		glog.Fatalln(err)
+	}
+
+	if err := initTemplates(); err != nil {
+		glog.Fatalln(err)
+	}
+
+	if err := checkKVLayout(); err != nil {
+		glog.Fatalln(err)
+	}
+
+	if err := checkAdoptPolicy(); err != nil {
+		glog.Fatalln(err)
+	}
+
+	if err := plugins.CheckNamespaceMode(); err != nil {
+		glog.Fatalln(err)
+	}
+
+	if drainPeriod > 0 {
+		sp.startDraining()
+	}
+
+	if podWeights {
+		sp.followPodWeights()
+	}
+
+	if metadataEnabled() || podWeights || drainPeriod > 0 {
+		pm.Metadata.Start()
+	}
+
 	ch := make(chan watch.Event)
 	pm.KubeWatcher.Subscribe(ch)
 
 	go func() {
-		for event := range ch {
-			switch event.Object.(type) {
-			case *kapi.Service, *kapi.Endpoints:
-				sp.handleEvent(event)
+		for {
+			select {
+			case event := <-ch:
+				switch event.Object.(type) {
+				case *kapi.Service, *api.ServiceEndpoints:
+					sp.handleEvent(event)
+				}
+			case <-pm.Done():
+				return
 			}
 		}
 	}()
@@ -50,15 +178,63 @@ func (sp *ServicePlugin) Initialize(pm *plugins.PluginManager) {
 func (sp *ServicePlugin) Sync() {
 	exportedServices := make(ServiceList)
 
+	// The resyncs of a target that is back, of an approval or of an agent
+	// change don't follow a database update
+	sp.pm.Db.Refresh()
+	listed := sp.pm.Db.Updated()
+
 	services := sp.pm.Db.ListServices()
+	if services == nil {
+		sp.errors.Errorf("Service list is not available, skip resync")
+		sp.setReport(plugins.PluginReport{Error: "Service list is not available"})
+		return
+	}
 
 	for _, svc := range services.Items {
-		ep := sp.pm.Db.GetEndpoints(svc.Name)
-		exportedServices[svc.Name] = sp.createService(svc, *ep)
+		if !sp.pm.Target.Exports(svc.Namespace, svc.Name) {
+			continue
+		}
+
+		ep := sp.pm.Db.GetEndpoints(svc.Namespace, svc.Name)
+		if ep == nil {
+			ep = &api.ServiceEndpoints{}
+			ep.Namespace, ep.Name = svc.Namespace, svc.Name
+		}
+		if svc, ep, ok := sp.listedService(svc, *ep, listed); ok {
+			exportedServices[serviceKey(svc.Namespace, svc.Name)] = sp.createService(svc, ep)
+		}
 	}
 
-	sp.updateKV(exportedServices)
-	sp.updateDNS(exportedServices)
+	for key, svc := range sp.watchedServices(listed) {
+		if _, ok := exportedServices[key]; !ok && sp.pm.Target.Exports(svc.Namespace, svc.Name) {
+			exportedServices[key] = sp.createService(svc, sp.getKubeEndpoints(key))
+		}
+	}
+
+	approved := sp.takeApproval()
+	sp.updateKV(exportedServices, approved)
+	instances := sp.updateDNS(exportedServices, approved)
+	sp.updateAllServiceDefaults(exportedServices, approved)
+	sp.updateAllQueries(exportedServices, approved)
+
+	sp.setReport(plugins.PluginReport{Services: len(exportedServices), Instances: instances})
+}
+
+func (sp *ServicePlugin) setReport(report plugins.PluginReport) {
+	sp.Lock()
+	sp.report = report
+	sp.Unlock()
+}
+
+// Report returns the number of services and registrations of the last
+// resync, and the last error since the previous report.
+func (sp *ServicePlugin) Report() plugins.PluginReport {
+	sp.Lock()
+	report := sp.report
+	sp.Unlock()
+
+	report.Error = sp.errors.Take()
+	return report
 }
 
 func (sp *ServicePlugin) handleEvent(event watch.Event) {
@@ -70,96 +246,223 @@ func (sp *ServicePlugin) handleEvent(event watch.Event) {
 	var (
 		event_type int
 		name       string
+		namespace  string
 	)
 
 	switch event.Object.(type) {
 	case *kapi.Service:
 		name = event.Object.(*kapi.Service).Name
+		namespace = event.Object.(*kapi.Service).Namespace
 		event_type = service
-	case *kapi.Endpoints:
-		name = event.Object.(*kapi.Endpoints).Name
+	case *api.ServiceEndpoints:
+		name = event.Object.(*api.ServiceEndpoints).Name
+		namespace = event.Object.(*api.ServiceEndpoints).Namespace
 		event_type = endpoint
 	default:
 		return
 	}
 
-	if event_type == endpoint && (event.Type == watch.Added || event.Type == watch.Modified) {
-		if svc, err := sp.getServiceKV(name); err != nil {
-			glog.Errorf("Cannot get service %s", name)
-			return
-		} else {
-			glog.Infof("Endpoint %s modified or added", name)
-
-			// Update svc with new endpoints
-			ep := event.Object.(*kapi.Endpoints)
-			svc.Endpoints = sp.getEnpointsIps(*ep)
-			sp.updateServiceKV(svc)
-			sp.updateServiceDNS(svc)
-		}
-	} else if event_type == service && event.Type == watch.Added {
-		// Add new service in KV. We don't add endpoints because we don't
-		// have any
-		glog.Infof("Service %s added", name)
+	if !sp.pm.Target.Exports(namespace, name) {
+		return
+	}
+	key := serviceKey(namespace, name)
 
-		kubeService := event.Object.(*kapi.Service)
-		svc := sp.createService(*kubeService, kapi.Endpoints{})
-		sp.updateServiceKV(svc)
+	if event_type == endpoint && (event.Type == watch.Added || event.Type == watch.Modified) {
+		glog.Infof("Endpoint %s modified or added", name)
 
-	} else if event_type == service && event.Type == watch.Modified {
-		if svc, err := sp.getServiceKV(name); err != nil {
-			glog.Errorf("Cannot get service %s", name)
-			return
-		} else {
-			// Update service with old endpoint
-			glog.Infof("Service %s modified", name)
+		ep := event.Object.(*api.ServiceEndpoints)
+		sp.storeEndpoints(*ep)
+		sp.scheduleUpdate(key)
 
-			ep := svc.Endpoints
+	} else if event_type == service && (event.Type == watch.Added || event.Type == watch.Modified) {
+		// Endpoints may not be known yet for a new service, in this case
+		// it is added without any
+		glog.Infof("Service %s added or modified", name)
 
-			kubeService := event.Object.(*kapi.Service)
-			svc = sp.createService(*kubeService, kapi.Endpoints{})
-			svc.Endpoints = ep
+		kubeService := event.Object.(*kapi.Service)
+		sp.storeService(*kubeService)
+		sp.scheduleUpdate(key)
 
-			sp.updateServiceKV(svc)
-			sp.updateServiceDNS(svc)
-		}
 	} else if event_type == service && event.Type == watch.Deleted {
 		glog.Infof("Service %s deleted", name)
 
-		kubeService := event.Object.(*kapi.Service)
-		sp.removeServiceKV(kubeService.Name)
-		sp.removeServiceDNS(kubeService.Name)
+		sp.cancelUpdate(key)
+		sp.forgetService(key)
+		sp.removeServiceKV(namespace, name)
+		sp.removeServiceDNS(key)
+		sp.removeServiceDefaults(namespace, name)
+		sp.removeServiceQueries(namespace, name)
 
 	} else {
 		return
 	}
 }
 
-func (sp *ServicePlugin) getEnpointsIps(ep kapi.Endpoints) (ips []string) {
-	ips = make([]string, 0)
+// updateService updates a service in Consul from the last known Kubernetes
+// objects, key being its namespace/name.
+func (sp *ServicePlugin) updateService(key string) {
+	if kubeService, ok := sp.getKubeService(key); !ok {
+		glog.Errorf("Cannot get service %s", key)
+	} else {
+		svc := sp.createService(kubeService, sp.getKubeEndpoints(key))
+		sp.updateServiceKV(svc)
+		sp.cleanDNS(sp.updateServiceDNS(svc, make(agentServices)), key)
+		sp.updateServiceDefaults(svc)
+		sp.updateServiceQueries(svc)
+	}
+}
+
+func (sp *ServicePlugin) storeService(svc kapi.Service) {
+	key := serviceKey(svc.Namespace, svc.Name)
+
+	sp.Lock()
+	sp.kubeServices[key] = svc
+	sp.kubeUpdated[key] = time.Now()
+	sp.Unlock()
+}
+
+func (sp *ServicePlugin) storeEndpoints(ep api.ServiceEndpoints) {
+	key := serviceKey(ep.Namespace, ep.Name)
+
+	sp.Lock()
+	sp.kubeEndpoints[key] = ep
+	sp.kubeUpdated[key] = time.Now()
+	sp.Unlock()
+}
+
+// listedService stores the objects of a service listed by the database at
+// the given time, unless the watch gave more recent ones, and returns the
+// most recent objects. ok is false when the service was deleted since.
+func (sp *ServicePlugin) listedService(svc kapi.Service, ep api.ServiceEndpoints, listed time.Time) (kapi.Service, api.ServiceEndpoints, bool) {
+	key := serviceKey(svc.Namespace, svc.Name)
+
+	sp.Lock()
+	defer sp.Unlock()
+
+	if updated, ok := sp.kubeUpdated[key]; ok && updated.After(listed) {
+		cached, ok := sp.kubeServices[key]
+		return cached, sp.kubeEndpoints[key], ok
+	}
+
+	sp.kubeServices[key] = svc
+	sp.kubeEndpoints[key] = ep
+	return svc, ep, true
+}
+
+// watchedServices returns the services the watch gave since the database
+// was listed, and forgets the times of the older events.
+func (sp *ServicePlugin) watchedServices(listed time.Time) map[string]kapi.Service {
+	services := make(map[string]kapi.Service)
 
+	sp.Lock()
+	defer sp.Unlock()
+
+	for key, updated := range sp.kubeUpdated {
+		if !updated.After(listed) {
+			delete(sp.kubeUpdated, key)
+		} else if svc, ok := sp.kubeServices[key]; ok {
+			services[key] = svc
+		}
+	}
+	return services
+}
+
+func (sp *ServicePlugin) getKubeService(key string) (svc kapi.Service, ok bool) {
+	sp.Lock()
+	svc, ok = sp.kubeServices[key]
+	sp.Unlock()
+	return svc, ok
+}
+
+func (sp *ServicePlugin) getKubeEndpoints(key string) (ep api.ServiceEndpoints) {
+	sp.Lock()
+	ep = sp.kubeEndpoints[key]
+	sp.Unlock()
+	return ep
+}
+
+// podServices returns the keys of the services having an endpoint of a pod.
+func (sp *ServicePlugin) podServices(namespace, podName string) []string {
+	sp.Lock()
+	defer sp.Unlock()
+
+	keys := make([]string, 0)
+	for key, ep := range sp.kubeEndpoints {
+		if ep.Namespace == namespace && hasPodEndpoint(ep, podName) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func hasPodEndpoint(ep api.ServiceEndpoints, podName string) bool {
 	for _, subset := range ep.Subsets {
-		for _, addr := range subset.Addresses {
-			ips = append(ips, addr.IP)
+		for _, address := range subset.Addresses {
+			if ref := address.TargetRef; ref != nil && ref.Kind == "Pod" && ref.Name == podName {
+				return true
+			}
 		}
 	}
+	return false
+}
+
+func (sp *ServicePlugin) forgetService(key string) {
+	sp.Lock()
+	delete(sp.kubeServices, key)
+	delete(sp.kubeEndpoints, key)
+	sp.kubeUpdated[key] = time.Now()
+	for id, state := range sp.flaps {
+		if state.service == key {
+			delete(sp.flaps, id)
+		}
+	}
+	sp.Unlock()
+}
+
+func (sp *ServicePlugin) getEnpointsIps(instances []instance) (ips []string) {
+	ips = make([]string, 0)
+
+	for _, inst := range instances {
+		ips = append(ips, inst.Address)
+	}
 
 	return ips
 }
 
-func (sp *ServicePlugin) createService(svc kapi.Service, ep kapi.Endpoints) Service {
+func (sp *ServicePlugin) createService(svc kapi.Service, ep api.ServiceEndpoints) Service {
 	ports := make(map[string]int)
 
-	ips := sp.getEnpointsIps(ep)
+	instances := selectInstances(ep)
+	ips := sp.getEnpointsIps(instances)
 
-	for _, port := range svc.Spec.Ports {
+	exported := exportedPorts(svc, ep)
+	for _, port := range exported {
 		ports[port.Name] = port.Port
 	}
 
 	se := Service{
+		Schema:      SERVICE_SCHEMA,
 		Name:        svc.Name,
+		Namespace:   svc.Namespace,
+		Labels:      svc.Labels,
 		Annotations: svc.Annotations,
 		Endpoints:   ips,
 		Ports:       ports,
+
+		Type:                string(svc.Spec.Type),
+		ClusterIPs:          clusterIPs(svc),
+		SessionAffinity:     string(svc.Spec.SessionAffinity),
+		LoadBalancerIngress: loadBalancerIngress(svc),
+		PortDetails:         exported,
+		EndpointDetails:     sp.endpointDetails(ep),
+
+		Generation:      svc.Generation,
+		ResourceVersion: svc.ResourceVersion,
+
+		uid:       string(svc.UID),
+		instances: instances,
+		tags:      labelTags(svc.Labels),
+		meta:      labelMeta(svc.Labels),
 	}
 
 	return se
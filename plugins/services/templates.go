@@ -0,0 +1,156 @@
+package service
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"strings"
+	"text/template"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+var (
+	nameTemplate string
+	idTemplate   string
+	tagsTemplate string
+
+	templates = make(map[string]*template.Template)
+
+	templateFuncs = template.FuncMap{
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		"replace": func(old, new, s string) string {
+			return strings.Replace(s, old, new, -1)
+		},
+	}
+)
+
+// templateData is given to the name, ID and tags templates.
+type templateData struct {
+	Namespace   string
+	Service     string
+	Port        string
+	PortName    string
+	PortNumber  int
+	Protocol    string
+	Labels      map[string]string
+	Annotations map[string]string
+
+	Address          string
+	AlternateAddress string
+	Pod              string
+	NodeName         string
+	Zone             string
+}
+
+func init() {
+	flag.StringVar(&nameTemplate, "name-template", "", "Go template of the Consul service name")
+	flag.StringVar(&idTemplate, "id-template", "", "Go template of the Consul service ID, must be unique per address and port")
+	flag.StringVar(&tagsTemplate, "tags-template", "", "Go template of comma separated tags added to the Consul service")
+}
+
+// initTemplates parses the templates and executes them once so that errors
+// are found at startup rather than on the first event. The sample has no
+// labels nor annotations, so an empty result is only rejected at runtime.
+func initTemplates() error {
+	sample := templateData{
+		Namespace:   kapi.NamespaceDefault,
+		Service:     "service",
+		Port:        "http",
+		PortName:    "http",
+		PortNumber:  80,
+		Protocol:    "tcp",
+		Labels:      map[string]string{},
+		Annotations: map[string]string{},
+		Address:     "10.0.0.1",
+	}
+
+	for name, text := range map[string]string{"name": nameTemplate, "id": idTemplate, "tags": tagsTemplate} {
+		if text == "" {
+			continue
+		}
+
+		t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return fmt.Errorf("Invalid %s template: %s", name, err)
+		}
+
+		if _, err := executeTemplate(t, sample); err != nil {
+			return fmt.Errorf("Invalid %s template: %s", name, err)
+		}
+
+		templates[name] = t
+	}
+
+	return nil
+}
+
+func executeTemplate(t *template.Template, data templateData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+func newTemplateData(svc Service, port servicePort, inst instance) templateData {
+	data := templateData{
+		Namespace:        svc.Namespace,
+		Service:          svc.Name,
+		Port:             consulPortName(port),
+		PortName:         port.Name,
+		PortNumber:       port.Port,
+		Protocol:         strings.ToLower(string(port.Protocol)),
+		Labels:           svc.Labels,
+		Annotations:      svc.Annotations,
+		Address:          inst.Address,
+		AlternateAddress: inst.AlternateAddress,
+		NodeName:         inst.Endpoint.NodeName,
+		Zone:             inst.Endpoint.Zone,
+	}
+
+	if ref := inst.Endpoint.TargetRef; ref != nil && ref.Kind == "Pod" {
+		data.Pod = ref.Name
+	}
+
+	return data
+}
+
+// instanceNaming returns the Consul name, ID and extra tags of an instance
+// port, from the templates or the default naming when they are not set. An
+// empty name or ID is an error, Consul rejecting the registration.
+func instanceNaming(svc Service, port servicePort, inst instance) (name, id string, tags []string, err error) {
+	data := newTemplateData(svc, port, inst)
+
+	name = consulServiceName(svc.Name, port)
+	if t, ok := templates["name"]; ok {
+		if name, err = executeTemplate(t, data); err != nil {
+			return
+		} else if name == "" {
+			err = fmt.Errorf("name template gave an empty name")
+			return
+		}
+	}
+
+	id = generateServiceID(svc.Name, consulPortName(port), inst.Address)
+	if t, ok := templates["id"]; ok {
+		if id, err = executeTemplate(t, data); err != nil {
+			return
+		} else if id == "" {
+			err = fmt.Errorf("ID template gave an empty ID")
+			return
+		}
+	}
+
+	tags = make([]string, 0)
+	if t, ok := templates["tags"]; ok {
+		var out string
+		if out, err = executeTemplate(t, data); err != nil {
+			return
+		}
+		tags = splitList(out)
+	}
+
+	return
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"flag"
+	"strconv"
+
+	"github.com/golang/glog"
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/watch"
+
+	"github.com/lightcode/kube2consul/core"
+)
+
+const (
+	ANNOTATION_WEIGHT_PASSING = "kube2consul/weight-passing"
+	ANNOTATION_WEIGHT_WARNING = "kube2consul/weight-warning"
+
+	// Consul default weights
+	DEFAULT_WEIGHT_PASSING = 1
+	DEFAULT_WEIGHT_WARNING = 1
+)
+
+var podWeights bool
+
+func init() {
+	flag.BoolVar(&podWeights, "pod-weights", false, "Read the weight annotations on pods too, they take precedence over the service ones")
+}
+
+// parseWeight reads a weight annotation, min being the lowest weight
+// accepted by Consul.
+func parseWeight(annotations map[string]string, key string, min int) (weight int, ok bool) {
+	value, ok := annotations[key]
+	if !ok {
+		return 0, false
+	}
+
+	weight, err := strconv.Atoi(value)
+	if err != nil || weight < min {
+		glog.Errorf("Invalid weight '%s' in annotation %s", value, key)
+		return 0, false
+	}
+	return weight, true
+}
+
+// instanceWeights returns the Consul weights of an instance from the
+// annotations of its service and pod, or nil when none is set.
+func (sp *ServicePlugin) instanceWeights(svc Service, inst instance) *api.AgentWeights {
+	annotations := make(map[string]string)
+	for _, key := range []string{ANNOTATION_WEIGHT_PASSING, ANNOTATION_WEIGHT_WARNING} {
+		if value, ok := svc.Annotations[key]; ok {
+			annotations[key] = value
+		}
+	}
+
+	if ref := inst.Endpoint.TargetRef; podWeights && ref != nil && ref.Kind == "Pod" {
+		if pod, ok := sp.pm.Metadata.GetPod(ref.Namespace, ref.Name); ok {
+			for _, key := range []string{ANNOTATION_WEIGHT_PASSING, ANNOTATION_WEIGHT_WARNING} {
+				if value, ok := pod.Annotations[key]; ok {
+					annotations[key] = value
+				}
+			}
+		}
+	}
+
+	passing, hasPassing := parseWeight(annotations, ANNOTATION_WEIGHT_PASSING, 1)
+	warning, hasWarning := parseWeight(annotations, ANNOTATION_WEIGHT_WARNING, 0)
+	if !hasPassing && !hasWarning {
+		return nil
+	}
+
+	weights := &api.AgentWeights{Passing: DEFAULT_WEIGHT_PASSING, Warning: DEFAULT_WEIGHT_WARNING}
+	if hasPassing {
+		weights.Passing = passing
+	}
+	if hasWarning {
+		weights.Warning = warning
+	}
+	return weights
+}
+
+// followPodWeights registers again the services of a pod when its weight
+// annotations change, the endpoints being left unchanged.
+func (sp *ServicePlugin) followPodWeights() {
+	ch := make(chan watch.Event)
+	sp.pm.Metadata.Subscribe(ch)
+
+	go func() {
+		for {
+			select {
+			case event := <-ch:
+				if pod, ok := event.Object.(*kapi.Pod); ok {
+					sp.handlePodWeights(event.Type, *pod)
+				}
+			case <-sp.pm.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (sp *ServicePlugin) handlePodWeights(eventType watch.EventType, pod kapi.Pod) {
+	key := serviceKey(pod.Namespace, pod.Name)
+	weights := pod.Annotations[ANNOTATION_WEIGHT_PASSING] + "/" + pod.Annotations[ANNOTATION_WEIGHT_WARNING]
+
+	sp.Lock()
+	previous, ok := sp.weightAnnotations[key]
+	if eventType == watch.Deleted {
+		delete(sp.weightAnnotations, key)
+	} else {
+		sp.weightAnnotations[key] = weights
+	}
+	sp.Unlock()
+
+	// A pod seen for the first time was registered with its current
+	// weights, unless it got them in the meantime
+	if eventType == watch.Deleted || weights == previous || (!ok && weights == "/") {
+		return
+	}
+
+	for _, service := range sp.podServices(pod.Namespace, pod.Name) {
+		glog.Infof("Weights of pod %s changed, update service %s", key, service)
+		sp.scheduleUpdate(service)
+	}
+}
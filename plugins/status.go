@@ -0,0 +1,207 @@
+package plugins
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	statusKey         string
+	heartbeatInterval time.Duration
+
+	// Version of kube2consul written in the status document, see SetVersion
+	version = "dev"
+)
+
+func init() {
+	flag.StringVar(&statusKey, "status-key", "", "KV key of the status document, <state-prefix>/<cluster>/status if empty")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", time.Second*30, "Interval at which the status document is written between syncs, 0 to only write it on syncs")
+}
+
+// SetVersion sets the version of kube2consul written in the status
+// document.
+func SetVersion(v string) {
+	version = v
+}
+
+// Reporter is implemented by the plugins reporting what they manage in the
+// status document.
+type Reporter interface {
+	Report() PluginReport
+}
+
+// ErrorLog logs the errors of a plugin and keeps the last one, so that it
+// can be reported in PluginReport.Error.
+type ErrorLog struct {
+	last string
+	sync.Mutex
+}
+
+// Errorf logs an error and records it.
+func (l *ErrorLog) Errorf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	glog.ErrorDepth(1, msg)
+
+	l.Lock()
+	l.last = msg
+	l.Unlock()
+}
+
+// Take returns and clears the last error, empty when there was none since
+// the previous call.
+func (l *ErrorLog) Take() string {
+	l.Lock()
+	defer l.Unlock()
+
+	msg := l.last
+	l.last = ""
+	return msg
+}
+
+// PluginReport is the result of the last sync of a plugin.
+type PluginReport struct {
+	Services  int    `json:"services"`
+	Instances int    `json:"instances"`
+	Error     string `json:"error,omitempty"`
+}
+
+// PluginStatus is the state of a plugin in the status document.
+type PluginStatus struct {
+	PluginReport
+	Result   string    `json:"result"`
+	LastSync time.Time `json:"last_sync"`
+	Duration string    `json:"duration"`
+}
+
+// StatusError is the last error of the target.
+type StatusError struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Status is the document telling whether kube2consul is alive and how its
+// last sync went, written in the KV of each target.
+type Status struct {
+	Leader    string                  `json:"leader"`
+	Cluster   string                  `json:"cluster"`
+	Target    string                  `json:"target"`
+	Version   string                  `json:"version"`
+	Started   time.Time               `json:"started"`
+	LastSync  time.Time               `json:"last_sync"`
+	Heartbeat time.Time               `json:"heartbeat"`
+	Plugins   map[string]PluginStatus `json:"plugins"`
+	Services  int                     `json:"services"`
+	Instances int                     `json:"instances"`
+	LastError *StatusError            `json:"last_error,omitempty"`
+}
+
+// targetStatus is the status of the plugins of a target.
+type targetStatus struct {
+	status Status
+	sync.Mutex
+}
+
+// StatusKey returns the KV key of the status document.
+func StatusKey() string {
+	if statusKey != "" {
+		return statusKey
+	}
+	return StateKey("status")
+}
+
+func newTargetStatus(t *Target) *targetStatus {
+	return &targetStatus{status: Status{
+		Leader:  OwnerInstance,
+		Cluster: ClusterName,
+		Target:  t.Name,
+		Version: version,
+		Started: time.Now(),
+		Plugins: make(map[string]PluginStatus),
+	}}
+}
+
+// syncPlugin syncs a plugin and records its result. The errors reported by
+// the plugin, or else the errors of the target backend during the sync, are
+// the errors of the plugin.
+func (r *targetRunner) syncPlugin(name string, p Plugin) {
+	start := time.Now()
+	p.Sync()
+	end := time.Now()
+
+	ps := PluginStatus{Result: "ok", LastSync: end, Duration: end.Sub(start).String()}
+	if reporter, ok := p.(Reporter); ok {
+		ps.PluginReport = reporter.Report()
+	}
+	if msg, at := r.target.Consul.LastError(); !at.Before(start) && ps.Error == "" {
+		ps.Error = msg
+	}
+	if ps.Error != "" {
+		ps.Result = "error"
+	}
+
+	r.status.Lock()
+	r.status.status.Plugins[name] = ps
+	if ps.Error != "" {
+		r.status.status.LastError = &StatusError{Message: ps.Error, Time: end}
+	}
+	r.status.Unlock()
+}
+
+// writeStatus writes the status document of the target, after a sync when
+// synced is true.
+func (r *targetRunner) writeStatus(synced bool) {
+	r.status.Lock()
+	status := &r.status.status
+	status.Heartbeat = time.Now()
+	if synced {
+		status.LastSync = status.Heartbeat
+	}
+
+	status.Services, status.Instances = 0, 0
+	for _, ps := range status.Plugins {
+		status.Services += ps.Services
+		status.Instances += ps.Instances
+	}
+
+	if msg, at := r.target.Consul.LastError(); !at.IsZero() && (status.LastError == nil || at.After(status.LastError.Time)) {
+		status.LastError = &StatusError{Message: msg, Time: at}
+	}
+
+	value, err := json.Marshal(status)
+	r.status.Unlock()
+
+	if err != nil {
+		glog.Errorf("Cannot encode status: %s", err)
+		return
+	}
+
+	// A target that is down is reported by its check, the status is written
+	// again by the next heartbeat
+	if err := r.target.Consul.SetKV(StatusKey(), value); err != nil {
+		glog.Errorf("Cannot write status of Consul target %s: %s", r.target.Name, err)
+	}
+}
+
+func (r *targetRunner) heartbeat() {
+	if heartbeatInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.retrySession()
+			r.writeStatus(false)
+		case <-r.done:
+			return
+		}
+	}
+}
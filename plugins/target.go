@@ -0,0 +1,84 @@
+package plugins
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lightcode/kube2consul/core"
+)
+
+// Target is a Consul datacenter the services are exported to.
+type Target struct {
+	Name   string
+	Consul *api.ConsulBackend
+
+	// Services exported to the target, matched on <namespace>/<name>
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+}
+
+// ParseTarget reads a target written as comma separated key=value pairs:
+// name, address, token and datacenter. The agents of the address are
+// separated by pipes. The regexps of the services it exports are set by
+// SetFilters, a regexp possibly containing any separator.
+func ParseTarget(spec string) (*Target, error) {
+	values := make(map[string]string)
+	for _, item := range strings.Split(spec, ",") {
+		s := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(s) != 2 {
+			return nil, fmt.Errorf("Invalid Consul target option '%s'", item)
+		}
+		values[s[0]] = s[1]
+	}
+
+	t := &Target{Name: values["name"]}
+	if t.Name == "" || values["address"] == "" {
+		return nil, fmt.Errorf("Consul target '%s' needs a name and an address", spec)
+	}
+
+	t.Consul = api.NewConsulTargetClient(values["address"], values["token"], values["datacenter"])
+	return t, nil
+}
+
+// SetFilters sets the include or exclude regexps of the targets, each of
+// the filters being written as <target name>=<regexp>.
+func SetFilters(targets []*Target, kind string, filters []string) error {
+	for _, filter := range filters {
+		s := strings.SplitN(filter, "=", 2)
+		if len(s) != 2 {
+			return fmt.Errorf("Invalid Consul target %s '%s'", kind, filter)
+		}
+
+		re, err := regexp.Compile(s[1])
+		if err != nil {
+			return fmt.Errorf("Invalid %s of Consul target %s: %s", kind, s[0], err)
+		}
+
+		found := false
+		for _, t := range targets {
+			if t.Name != s[0] {
+				continue
+			}
+			found = true
+			if kind == "include" {
+				t.Include = re
+			} else {
+				t.Exclude = re
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown Consul target '%s' of %s '%s'", s[0], kind, filter)
+		}
+	}
+	return nil
+}
+
+// Exports tells if a Kubernetes service is exported to the target.
+func (t *Target) Exports(namespace, name string) bool {
+	s := namespace + "/" + name
+	if t.Include != nil && !t.Include.MatchString(s) {
+		return false
+	}
+	return t.Exclude == nil || !t.Exclude.MatchString(s)
+}